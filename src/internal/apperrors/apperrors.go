@@ -11,6 +11,10 @@ var (
 	ErrNotFound = errors.New("resource not found")
 	// ErrUnauthorized is a sentinel error for when a user lacks permissions
 	ErrUnauthorized = errors.New("unauthorized access")
+	// ErrInvalidInput is a sentinel error for requests failing validation
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrLastUpstream is a sentinel error for removing the last upstream in rotation
+	ErrLastUpstream = errors.New("cannot remove last DNS server")
 )
 
 // type ConfigNotFound struct {
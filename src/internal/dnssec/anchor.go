@@ -0,0 +1,40 @@
+package dnssec
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// rootAnchors are the DS records of the root key signing keys published by
+// IANA, KSK-2017 and KSK-2024
+var rootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// RootAnchors returns the trust anchors of the root zone
+func RootAnchors() []*dns.DS {
+	anchors, err := ParseAnchors(rootAnchors)
+	if err != nil {
+		panic(err)
+	}
+	return anchors
+}
+
+// ParseAnchors parses root DS records in presentation format
+func ParseAnchors(records []string) ([]*dns.DS, error) {
+	anchors := make([]*dns.DS, 0, len(records))
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor %q: %w", record, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok || ds.Hdr.Name != "." {
+			return nil, fmt.Errorf("trust anchor %q is not a DS record of the root", record)
+		}
+		anchors = append(anchors, ds)
+	}
+	return anchors, nil
+}
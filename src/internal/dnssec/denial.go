@@ -0,0 +1,204 @@
+package dnssec
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxNSEC3Iterations more iterations make answers insecure as of RFC 9276
+const maxNSEC3Iterations = 150
+
+// denial is the outcome of checking NSEC or NSEC3 records
+type denial int
+
+const (
+	// missing proof makes an answer bogus
+	missing denial = iota
+	// proven denials are secure
+	proven
+	// optOut denials may hide unsigned delegations and are insecure
+	optOut
+)
+
+// prove checks that nsecs or nsec3s deny records of qtype at name, or name
+// itself when nxdomain is set. The type bitmap of the record matching name
+// is returned for proofs of missing types.
+func prove(nsecs []*dns.NSEC, nsec3s []*dns.NSEC3, name string, qtype uint16, nxdomain bool) (denial, []uint16) {
+	if len(nsecs) > 0 {
+		return proveNSEC(nsecs, name, qtype, nxdomain)
+	}
+	if len(nsec3s) > 0 {
+		return proveNSEC3(nsec3s, name, qtype, nxdomain)
+	}
+	return missing, nil
+}
+
+func proveNSEC(nsecs []*dns.NSEC, name string, qtype uint16, nxdomain bool) (denial, []uint16) {
+	if !nxdomain {
+		for _, nsec := range nsecs {
+			if canonical(nsec.Hdr.Name) == name {
+				if lacks(nsec.TypeBitMap, qtype) {
+					return proven, nsec.TypeBitMap
+				}
+				return missing, nil
+			}
+		}
+	}
+
+	// name does not exist and neither does a wildcard that could have
+	// answered, or the wildcard lacks the type
+	for _, nsec := range nsecs {
+		if !covers(nsec, name) {
+			continue
+		}
+		wildcard := "*." + closestEncloser(name, nsec)
+		if wildcard == "*.." {
+			wildcard = "*."
+		}
+		for _, w := range nsecs {
+			if nxdomain && covers(w, wildcard) {
+				return proven, nil
+			}
+			if !nxdomain && canonical(w.Hdr.Name) == wildcard && lacks(w.TypeBitMap, qtype) {
+				return proven, w.TypeBitMap
+			}
+		}
+	}
+	return missing, nil
+}
+
+func proveNSEC3(nsec3s []*dns.NSEC3, name string, qtype uint16, nxdomain bool) (denial, []uint16) {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Iterations > maxNSEC3Iterations || nsec3.Hash != dns.SHA1 {
+			// too costly or impossible to check, insecure like opt-out
+			return optOut, nil
+		}
+	}
+	if !nxdomain {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(name) {
+				if lacks(nsec3.TypeBitMap, qtype) {
+					return proven, nsec3.TypeBitMap
+				}
+				return missing, nil
+			}
+		}
+	}
+
+	encloser, nextCloser := nsec3Encloser(nsec3s, name)
+	if nextCloser == nil {
+		return missing, nil
+	}
+	wildcard := "*." + encloser
+	if encloser == "." {
+		wildcard = "*."
+	}
+	if nxdomain {
+		for _, nsec3 := range nsec3s {
+			if coversNSEC3(nsec3, wildcard) {
+				if nextCloser.Flags&1 != 0 {
+					return optOut, nil
+				}
+				return proven, nil
+			}
+		}
+		return missing, nil
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(wildcard) && lacks(nsec3.TypeBitMap, qtype) {
+			return proven, nsec3.TypeBitMap
+		}
+	}
+	if qtype == dns.TypeDS && nextCloser.Flags&1 != 0 {
+		return optOut, nil
+	}
+	return missing, nil
+}
+
+// coversName reports whether the records prove that name does not exist.
+// NSEC3 records prove it by covering nextCloser.
+func coversName(nsecs []*dns.NSEC, nsec3s []*dns.NSEC3, name, nextCloser string) bool {
+	for _, nsec := range nsecs {
+		if covers(nsec, name) {
+			return true
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if coversNSEC3(nsec3, nextCloser) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3Encloser finds the closest existing ancestor of name and the NSEC3
+// record covering the name one label below it
+func nsec3Encloser(nsec3s []*dns.NSEC3, name string) (string, *dns.NSEC3) {
+	labels := dns.CountLabel(name)
+	for i := 1; i <= labels; i++ {
+		encloser := suffix(name, i)
+		if !slices.ContainsFunc(nsec3s, func(nsec3 *dns.NSEC3) bool { return nsec3.Match(encloser) }) {
+			continue
+		}
+		nextCloser := suffix(name, i-1)
+		for _, nsec3 := range nsec3s {
+			if coversNSEC3(nsec3, nextCloser) {
+				return encloser, nsec3
+			}
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+// coversNSEC3 reports whether the hash of name falls between the owner and
+// next hash of nsec3
+func coversNSEC3(nsec3 *dns.NSEC3, name string) bool {
+	return !nsec3.Match(name) && nsec3.Cover(name)
+}
+
+// covers reports whether name falls between the owner and next name of
+// nsec. Records of delegations do not cover names below the delegation.
+func covers(nsec *dns.NSEC, name string) bool {
+	owner, next := canonical(nsec.Hdr.Name), canonical(nsec.NextDomain)
+	if hasType(nsec.TypeBitMap, dns.TypeNS) && !hasType(nsec.TypeBitMap, dns.TypeSOA) && dns.IsSubDomain(owner, name) {
+		return false
+	}
+	if compareNames(owner, name) >= 0 {
+		return false
+	}
+	if compareNames(owner, next) < 0 {
+		return compareNames(name, next) < 0
+	}
+	// the last record of the zone points back to the apex
+	return dns.IsSubDomain(next, name)
+}
+
+// closestEncloser returns the closest ancestor of name proven to exist by
+// nsec covering it
+func closestEncloser(name string, nsec *dns.NSEC) string {
+	common := max(dns.CompareDomainName(name, nsec.Hdr.Name), dns.CompareDomainName(name, nsec.NextDomain))
+	return suffix(name, dns.CountLabel(name)-common)
+}
+
+// compareNames orders names canonically as of RFC 4034 6.1
+func compareNames(a, b string) int {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// lacks reports whether a type bitmap proves the absence of qtype
+func lacks(types []uint16, qtype uint16) bool {
+	return !hasType(types, qtype) && !hasType(types, dns.TypeCNAME)
+}
+
+func hasType(types []uint16, rrtype uint16) bool {
+	return slices.Contains(types, rrtype)
+}
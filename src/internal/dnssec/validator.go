@@ -0,0 +1,648 @@
+// Package dnssec validates DNS answers against a chain of trust starting at
+// the root trust anchors. Records needed to build the chain are queried
+// through the exchange function of the caller, which sends them to the
+// default servers whichever servers gave the answer. Answers of forwarded
+// zones are not handed to the validator and stay insecure.
+package dnssec
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxKeyTTL bounds how long validated keys of a zone are reused
+	maxKeyTTL = time.Hour
+	// maxChainDepth bounds the zones followed up to the trust anchor
+	maxChainDepth = 32
+)
+
+// Security is the outcome of validation
+type Security int
+
+const (
+	// Insecure answers come from unsigned zones
+	Insecure Security = iota
+	// Secure answers are signed by a chain of trust from a trust anchor
+	Secure
+	// Bogus answers fail validation
+	Bogus
+)
+
+func (s Security) String() string {
+	switch s {
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	}
+	return "insecure"
+}
+
+// Result describes the validation of an answer
+type Result struct {
+	Security Security
+	// InfoCode is the extended DNS error explaining bogus answers
+	InfoCode uint16
+	// Reason tells why the answer is bogus
+	Reason string
+}
+
+func bogus(infoCode uint16, format string, args ...any) Result {
+	return Result{Security: Bogus, InfoCode: infoCode, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Exchange sends a query for records needed by validation
+type Exchange func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+
+// zone holds the validated keys of a zone, no keys when the zone is unsigned
+type zone struct {
+	name    string
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+func (z *zone) secure() bool {
+	return len(z.keys) > 0
+}
+
+// Validator checks answers against a chain of trust from the root trust
+// anchors. Validated keys are reused until their TTL passes.
+type Validator struct {
+	anchors []*dns.DS
+	mu      sync.Mutex
+	zones   map[string]*zone
+	now     func() time.Time
+}
+
+func NewValidator(anchors []*dns.DS) *Validator {
+	return &Validator{
+		anchors: anchors,
+		zones:   make(map[string]*zone),
+		now:     time.Now,
+	}
+}
+
+// Validate checks response, an answer with DNSSEC records obtained without
+// validation by the upstream. Records needed for the chain of trust are
+// queried through exchange.
+func (v *Validator) Validate(ctx context.Context, exchange Exchange, response *dns.Msg) Result {
+	if len(response.Question) == 0 {
+		return Result{}
+	}
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		// failures carry nothing to validate
+		return Result{}
+	}
+	question := response.Question[0]
+
+	security := Secure
+	for _, set := range rrsets(response.Answer) {
+		if set.rrtype == dns.TypeCNAME && len(set.sigs) == 0 && synthesized(response.Answer, set.name) {
+			// CNAMEs synthesized from a DNAME are unsigned, the DNAME is
+			// validated instead
+			continue
+		}
+		result := v.verifySet(ctx, exchange, set, response.Ns)
+		if result.Security == Bogus {
+			return result
+		}
+		if result.Security == Insecure {
+			security = Insecure
+		}
+	}
+
+	// a negative answer or the end of a CNAME chain without records of the
+	// question type needs proof that the records do not exist
+	target := chainEnd(response.Answer, question.Name)
+	if response.Rcode == dns.RcodeSuccess && answered(response.Answer, target, question.Qtype) {
+		return Result{Security: security}
+	}
+	result := v.verifyDenial(ctx, exchange, response.Ns, target, question.Qtype, response.Rcode == dns.RcodeNameError)
+	if result.Security == Secure {
+		result.Security = security
+	}
+	return result
+}
+
+// verifySet checks the signatures of set. Unsigned sets are accepted only
+// inside zones proven to be unsigned. Sets expanded from a wildcard need
+// proof in ns that their name does not exist.
+func (v *Validator) verifySet(ctx context.Context, exchange Exchange, set *rrset, ns []dns.RR) Result {
+	if len(set.sigs) == 0 {
+		insecure, result := v.insecure(ctx, exchange, set.name)
+		if result.Security == Bogus || insecure {
+			return result
+		}
+		return bogus(dns.ExtendedErrorCodeRRSIGsMissing, "%s %s is not signed", set.name, dns.TypeToString[set.rrtype])
+	}
+
+	signer := canonical(set.sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, set.name) {
+		return bogus(dns.ExtendedErrorCodeDNSBogus, "%s %s is signed by %s outside its zone", set.name, dns.TypeToString[set.rrtype], signer)
+	}
+	z, result := v.zoneOf(ctx, exchange, signer, 0)
+	if result.Security == Bogus || !z.secure() {
+		return result
+	}
+	sig, result := v.verify(set, z)
+	if result.Security == Bogus {
+		return result
+	}
+
+	if labels := dns.CountLabel(set.name); int(sig.Labels) < labels {
+		nextCloser := suffix(set.name, labels-int(sig.Labels)-1)
+		nsecs, nsec3s, result := v.denialRecords(ns, z)
+		if result.Security == Bogus {
+			return result
+		}
+		if !coversName(nsecs, nsec3s, set.name, nextCloser) {
+			return bogus(dns.ExtendedErrorCodeNSECMissing, "no proof that %s is expanded from a wildcard", set.name)
+		}
+	}
+	return Result{Security: Secure}
+}
+
+// verify checks that a signature of z covers set
+func (v *Validator) verify(set *rrset, z *zone) (*dns.RRSIG, Result) {
+	now := v.now()
+	var expired, notYetValid bool
+	for _, sig := range set.sigs {
+		if canonical(sig.SignerName) != z.name {
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			if int32(sig.Inception-uint32(now.Unix())) > 0 {
+				notYetValid = true
+			} else {
+				expired = true
+			}
+			continue
+		}
+		for _, key := range z.keys {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, set.rrs) == nil {
+				return sig, Result{Security: Secure}
+			}
+		}
+	}
+	rrtype := dns.TypeToString[set.rrtype]
+	switch {
+	case expired:
+		return nil, bogus(dns.ExtendedErrorCodeSignatureExpired, "signature of %s %s expired", set.name, rrtype)
+	case notYetValid:
+		return nil, bogus(dns.ExtendedErrorCodeSignatureNotYetValid, "signature of %s %s is not yet valid", set.name, rrtype)
+	}
+	return nil, bogus(dns.ExtendedErrorCodeDNSBogus, "no valid signature of %s %s by %s", set.name, rrtype, z.name)
+}
+
+// verifyDenial checks that ns proves that name has no records of qtype, or
+// does not exist at all when nxdomain is set
+func (v *Validator) verifyDenial(ctx context.Context, exchange Exchange, ns []dns.RR, name string, qtype uint16, nxdomain bool) Result {
+	name = canonical(name)
+	var signer string
+	for _, set := range rrsets(ns) {
+		if len(set.sigs) > 0 {
+			signer = canonical(set.sigs[0].SignerName)
+			break
+		}
+	}
+	if signer == "" {
+		insecure, result := v.insecure(ctx, exchange, name)
+		if result.Security == Bogus || insecure {
+			return result
+		}
+		return bogus(dns.ExtendedErrorCodeNSECMissing, "no signed proof that %s %s does not exist", name, dns.TypeToString[qtype])
+	}
+	if !dns.IsSubDomain(signer, name) {
+		return bogus(dns.ExtendedErrorCodeDNSBogus, "proof for %s is signed by %s outside its zone", name, signer)
+	}
+	z, result := v.zoneOf(ctx, exchange, signer, 0)
+	if result.Security == Bogus || !z.secure() {
+		return result
+	}
+	nsecs, nsec3s, result := v.denialRecords(ns, z)
+	if result.Security == Bogus {
+		return result
+	}
+	switch proof, _ := prove(nsecs, nsec3s, name, qtype, nxdomain); proof {
+	case proven:
+		return Result{Security: Secure}
+	case optOut:
+		return Result{Security: Insecure}
+	}
+	return bogus(dns.ExtendedErrorCodeNSECMissing, "no proof that %s %s does not exist", name, dns.TypeToString[qtype])
+}
+
+// denialRecords returns the NSEC and NSEC3 records of ns after checking
+// that z signed them and the SOA
+func (v *Validator) denialRecords(ns []dns.RR, z *zone) ([]*dns.NSEC, []*dns.NSEC3, Result) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, set := range rrsets(ns) {
+		if set.rrtype != dns.TypeSOA && set.rrtype != dns.TypeNSEC && set.rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		if _, result := v.verify(set, z); result.Security == Bogus {
+			return nil, nil, result
+		}
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+	return nsecs, nsec3s, Result{Security: Secure}
+}
+
+// zoneOf returns the validated keys of the zone name
+func (v *Validator) zoneOf(ctx context.Context, exchange Exchange, name string, depth int) (*zone, Result) {
+	if z := v.cached(name); z != nil {
+		return z, Result{Security: z.security()}
+	}
+	if depth > maxChainDepth {
+		return nil, bogus(dns.ExtendedErrorCodeDNSBogus, "chain of trust of %s is too long", name)
+	}
+	if name == "." {
+		return v.keysOf(ctx, exchange, name, v.anchors)
+	}
+
+	cut, ds, result := v.delegation(ctx, exchange, name, depth)
+	switch {
+	case result.Security == Bogus:
+		return nil, result
+	case cut == notCut:
+		return nil, bogus(dns.ExtendedErrorCodeDNSBogus, "%s signs records but is not a zone", name)
+	case cut == insecureCut:
+		return v.store(&zone{name: name}, maxKeyTTL), Result{Security: Insecure}
+	}
+	return v.keysOf(ctx, exchange, name, ds)
+}
+
+// keysOf validates the DNSKEY records of the zone name with ds, the DS
+// records of the parent or the trust anchors
+func (v *Validator) keysOf(ctx context.Context, exchange Exchange, name string, ds []*dns.DS) (*zone, Result) {
+	ds = supportedDS(ds)
+	if len(ds) == 0 {
+		// zones signed with unknown algorithms are treated as unsigned
+		return v.store(&zone{name: name}, maxKeyTTL), Result{Security: Insecure}
+	}
+
+	response, err := lookup(ctx, exchange, name, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, bogus(dns.ExtendedErrorCodeNetworkError, "DNSKEY lookup of %s failed: %v", name, err)
+	}
+	var set *rrset
+	for _, s := range rrsets(response.Answer) {
+		if s.name == name && s.rrtype == dns.TypeDNSKEY {
+			set = s
+		}
+	}
+	if set == nil {
+		return nil, bogus(dns.ExtendedErrorCodeDNSKEYMissing, "%s has no DNSKEY records", name)
+	}
+
+	var entryKeys, zoneKeys []*dns.DNSKEY
+	for _, rr := range set.rrs {
+		key := rr.(*dns.DNSKEY)
+		if key.Flags&dns.ZONE == 0 || key.Flags&dns.REVOKE != 0 {
+			continue
+		}
+		zoneKeys = append(zoneKeys, key)
+		if matchesDS(key, ds) {
+			entryKeys = append(entryKeys, key)
+		}
+	}
+	if len(entryKeys) == 0 {
+		return nil, bogus(dns.ExtendedErrorCodeDNSKEYMissing, "no DNSKEY of %s matches its DS records", name)
+	}
+	if _, result := v.verify(set, &zone{name: name, keys: entryKeys}); result.Security == Bogus {
+		return nil, result
+	}
+	ttl := time.Duration(set.rrs[0].Header().Ttl) * time.Second
+	return v.store(&zone{name: name, keys: zoneKeys}, ttl), Result{Security: Secure}
+}
+
+// cut tells what a DS lookup revealed about a name
+type cut int
+
+const (
+	// notCut names are inside the zone of their parent
+	notCut cut = iota
+	// secureCut names start a signed zone
+	secureCut
+	// insecureCut names start an unsigned zone
+	insecureCut
+)
+
+// delegation returns the validated DS records of name. Without DS records
+// name is an unsigned zone when its parent is unsigned or proves that name
+// is delegated without DS records.
+func (v *Validator) delegation(ctx context.Context, exchange Exchange, name string, depth int) (cut, []*dns.DS, Result) {
+	response, err := lookup(ctx, exchange, name, dns.TypeDS)
+	if err != nil {
+		return notCut, nil, bogus(dns.ExtendedErrorCodeNetworkError, "DS lookup of %s failed: %v", name, err)
+	}
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return notCut, nil, bogus(dns.ExtendedErrorCodeNetworkError, "DS lookup of %s failed with %s", name, dns.RcodeToString[response.Rcode])
+	}
+
+	for _, set := range rrsets(response.Answer) {
+		if set.name != name || set.rrtype != dns.TypeDS {
+			continue
+		}
+		if len(set.sigs) == 0 {
+			return v.unsignedDelegation(ctx, exchange, name)
+		}
+		signer := canonical(set.sigs[0].SignerName)
+		if signer == name || !dns.IsSubDomain(signer, name) {
+			return notCut, nil, bogus(dns.ExtendedErrorCodeDNSBogus, "DS of %s is not signed by its parent", name)
+		}
+		parent, result := v.zoneOf(ctx, exchange, signer, depth+1)
+		if result.Security == Bogus {
+			return notCut, nil, result
+		}
+		if !parent.secure() {
+			return insecureCut, nil, Result{Security: Insecure}
+		}
+		if _, result := v.verify(set, parent); result.Security == Bogus {
+			return notCut, nil, result
+		}
+		ds := make([]*dns.DS, 0, len(set.rrs))
+		for _, rr := range set.rrs {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		return secureCut, ds, Result{Security: Secure}
+	}
+
+	// no DS records, the parent has to prove it
+	var signer string
+	for _, set := range rrsets(response.Ns) {
+		if len(set.sigs) > 0 {
+			signer = canonical(set.sigs[0].SignerName)
+			break
+		}
+	}
+	if signer == "" {
+		return v.unsignedDelegation(ctx, exchange, name)
+	}
+	if !dns.IsSubDomain(signer, name) {
+		return notCut, nil, bogus(dns.ExtendedErrorCodeDNSBogus, "DS proof for %s is signed by %s outside its zone", name, signer)
+	}
+	if signer == name {
+		// the zone itself answered, name is a cut and its parent lacks
+		// the DS records
+		return notCut, nil, bogus(dns.ExtendedErrorCodeDNSBogus, "DS of %s answered by the zone itself", name)
+	}
+	parent, result := v.zoneOf(ctx, exchange, signer, depth+1)
+	if result.Security == Bogus {
+		return notCut, nil, result
+	}
+	if !parent.secure() {
+		return insecureCut, nil, Result{Security: Insecure}
+	}
+	nsecs, nsec3s, result := v.denialRecords(response.Ns, parent)
+	if result.Security == Bogus {
+		return notCut, nil, result
+	}
+	proof, types := prove(nsecs, nsec3s, name, dns.TypeDS, response.Rcode == dns.RcodeNameError)
+	switch {
+	case proof == optOut:
+		return insecureCut, nil, Result{Security: Insecure}
+	case proof == proven && response.Rcode != dns.RcodeNameError && hasType(types, dns.TypeNS):
+		return insecureCut, nil, Result{Security: Insecure}
+	case proof == proven:
+		// names proven not to exist are no cut either
+		return notCut, nil, Result{Security: Secure}
+	}
+	return notCut, nil, bogus(dns.ExtendedErrorCodeNSECMissing, "no proof that %s has no DS records", name)
+}
+
+// unsignedDelegation accepts unsigned DS answers for names below an
+// unsigned zone only
+func (v *Validator) unsignedDelegation(ctx context.Context, exchange Exchange, name string) (cut, []*dns.DS, Result) {
+	insecure, result := v.insecure(ctx, exchange, parent(name))
+	if result.Security == Bogus {
+		return notCut, nil, result
+	}
+	if insecure {
+		return insecureCut, nil, Result{Security: Insecure}
+	}
+	return notCut, nil, bogus(dns.ExtendedErrorCodeRRSIGsMissing, "DS answer for %s is not signed", name)
+}
+
+// insecure reports whether name is inside a zone proven to be unsigned. The
+// delegations from the root down to name are followed to find it.
+func (v *Validator) insecure(ctx context.Context, exchange Exchange, name string) (bool, Result) {
+	current, result := v.zoneOf(ctx, exchange, ".", 0)
+	if result.Security == Bogus {
+		return false, result
+	}
+	name = canonical(name)
+	labels := dns.CountLabel(name)
+	for i := labels - 1; i >= 0; i-- {
+		if !current.secure() {
+			return true, Result{Security: Insecure}
+		}
+		child := suffix(name, i)
+		if z := v.cached(child); z != nil {
+			current = z
+			continue
+		}
+		cut, ds, result := v.delegation(ctx, exchange, child, 0)
+		if result.Security == Bogus {
+			return false, result
+		}
+		switch cut {
+		case insecureCut:
+			return true, Result{Security: Insecure}
+		case secureCut:
+			current, result = v.keysOf(ctx, exchange, child, ds)
+			if result.Security == Bogus {
+				return false, result
+			}
+		}
+	}
+	return !current.secure(), Result{Security: current.security()}
+}
+
+func (z *zone) security() Security {
+	if z.secure() {
+		return Secure
+	}
+	return Insecure
+}
+
+func (v *Validator) cached(name string) *zone {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	z, ok := v.zones[name]
+	if !ok || !v.now().Before(z.expires) {
+		return nil
+	}
+	return z
+}
+
+func (v *Validator) store(z *zone, ttl time.Duration) *zone {
+	z.expires = v.now().Add(min(ttl, maxKeyTTL))
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.zones[z.name] = z
+	return z
+}
+
+// lookup queries records needed by validation. The upstream is asked for
+// DNSSEC records without validating them itself.
+func lookup(ctx context.Context, exchange Exchange, name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.RecursionDesired = true
+	msg.CheckingDisabled = true
+	msg.SetEdns0(dns.DefaultMsgSize, true)
+	return exchange(ctx, msg)
+}
+
+// rrset is a set of records of the same name and type with the signatures
+// covering it
+type rrset struct {
+	name   string
+	rrtype uint16
+	rrs    []dns.RR
+	sigs   []*dns.RRSIG
+}
+
+// rrsets groups the records of section into sets in order of appearance
+func rrsets(section []dns.RR) []*rrset {
+	var sets []*rrset
+	find := func(name string, rrtype uint16) *rrset {
+		for _, set := range sets {
+			if set.name == name && set.rrtype == rrtype {
+				return set
+			}
+		}
+		set := &rrset{name: name, rrtype: rrtype}
+		sets = append(sets, set)
+		return set
+	}
+	for _, rr := range section {
+		name := canonical(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.RRSIG:
+			set := find(name, rr.TypeCovered)
+			set.sigs = append(set.sigs, rr)
+		case *dns.OPT:
+		default:
+			set := find(name, rr.Header().Rrtype)
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+	// signatures without records are of no use
+	n := 0
+	for _, set := range sets {
+		if len(set.rrs) > 0 {
+			sets[n] = set
+			n++
+		}
+	}
+	return sets[:n]
+}
+
+// chainEnd follows the CNAME records of answer from name
+func chainEnd(answer []dns.RR, name string) string {
+	name = canonical(name)
+	for range answer {
+		next := ""
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && canonical(cname.Hdr.Name) == name {
+				next = canonical(cname.Target)
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	return name
+}
+
+// synthesized reports whether answer holds a DNAME above name
+func synthesized(answer []dns.RR, name string) bool {
+	for _, rr := range answer {
+		if dname, ok := rr.(*dns.DNAME); ok && name != canonical(dname.Hdr.Name) && dns.IsSubDomain(canonical(dname.Hdr.Name), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// answered reports whether answer holds records of qtype for name
+func answered(answer []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range answer {
+		if canonical(rr.Header().Name) != name {
+			continue
+		}
+		if rrtype := rr.Header().Rrtype; rrtype == qtype || qtype == dns.TypeANY || (rrtype == dns.TypeCNAME && qtype != dns.TypeRRSIG) {
+			return true
+		}
+	}
+	return false
+}
+
+// supportedDS returns the DS records of algorithms and digests this
+// validator can check
+func supportedDS(ds []*dns.DS) []*dns.DS {
+	var supported []*dns.DS
+	for _, d := range ds {
+		if supportedAlgorithm(d.Algorithm) && (d.DigestType == dns.SHA1 || d.DigestType == dns.SHA256 || d.DigestType == dns.SHA384) {
+			supported = append(supported, d)
+		}
+	}
+	return supported
+}
+
+func supportedAlgorithm(algorithm uint8) bool {
+	switch algorithm {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+// matchesDS reports whether key is referred to by one of ds
+func matchesDS(key *dns.DNSKEY, ds []*dns.DS) bool {
+	for _, d := range ds {
+		if d.KeyTag != key.KeyTag() || d.Algorithm != key.Algorithm {
+			continue
+		}
+		if keyDS := key.ToDS(d.DigestType); keyDS != nil && strings.EqualFold(keyDS.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+func canonical(name string) string {
+	return dns.CanonicalName(name)
+}
+
+// suffix returns name without its first n labels
+func suffix(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	if n >= len(labels) {
+		return "."
+	}
+	return dns.Fqdn(strings.Join(labels[n:], "."))
+}
+
+// parent returns the name of the parent of name
+func parent(name string) string {
+	return suffix(name, 1)
+}
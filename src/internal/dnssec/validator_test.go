@@ -0,0 +1,150 @@
+package dnssec
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestValidator_Validate(t *testing.T) {
+	h := newTestHierarchy(t)
+	other := newTestZone(t, ".", true, false)
+
+	withoutSigs := func(section []dns.RR) []dns.RR {
+		var rrs []dns.RR
+		for _, rr := range section {
+			if _, ok := rr.(*dns.RRSIG); !ok {
+				rrs = append(rrs, rr)
+			}
+		}
+		return rrs
+	}
+
+	tests := []struct {
+		name     string
+		qname    string
+		qtype    uint16
+		tamper   func(response *dns.Msg)
+		setup    func(v *Validator)
+		security Security
+		infoCode uint16
+	}{
+		{name: "signed answer", qname: "www.example.", qtype: dns.TypeA, security: Secure},
+		{name: "signed CNAME chain", qname: "alias.example.", qtype: dns.TypeA, security: Secure},
+		{name: "wildcard expansion", qname: "any.wild.example.", qtype: dns.TypeA, security: Secure},
+		{name: "signed NXDOMAIN", qname: "missing.example.", qtype: dns.TypeA, security: Secure},
+		{name: "signed NODATA", qname: "www.example.", qtype: dns.TypeAAAA, security: Secure},
+		{name: "NSEC3 answer", qname: "www.nsec3.", qtype: dns.TypeA, security: Secure},
+		{name: "NSEC3 NXDOMAIN", qname: "missing.nsec3.", qtype: dns.TypeA, security: Secure},
+		{name: "NSEC3 NODATA", qname: "www.nsec3.", qtype: dns.TypeAAAA, security: Secure},
+		{name: "unsigned zone", qname: "www.insecure.", qtype: dns.TypeA, security: Insecure},
+		{name: "unsigned NXDOMAIN", qname: "missing.insecure.", qtype: dns.TypeA, security: Insecure},
+		{
+			name:  "tampered answer",
+			qname: "www.example.", qtype: dns.TypeA,
+			tamper: func(response *dns.Msg) {
+				response.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.99")
+			},
+			security: Bogus, infoCode: dns.ExtendedErrorCodeDNSBogus,
+		},
+		{
+			name:  "stripped signatures",
+			qname: "www.example.", qtype: dns.TypeA,
+			tamper: func(response *dns.Msg) {
+				response.Answer = withoutSigs(response.Answer)
+			},
+			security: Bogus, infoCode: dns.ExtendedErrorCodeRRSIGsMissing,
+		},
+		{
+			name:  "NXDOMAIN without proof",
+			qname: "missing.example.", qtype: dns.TypeA,
+			tamper: func(response *dns.Msg) {
+				response.Ns = nil
+			},
+			security: Bogus, infoCode: dns.ExtendedErrorCodeNSECMissing,
+		},
+		{
+			name:  "wildcard without proof",
+			qname: "any.wild.example.", qtype: dns.TypeA,
+			tamper: func(response *dns.Msg) {
+				response.Ns = nil
+			},
+			security: Bogus, infoCode: dns.ExtendedErrorCodeNSECMissing,
+		},
+		{
+			name:  "expired signatures",
+			qname: "www.example.", qtype: dns.TypeA,
+			setup: func(v *Validator) {
+				v.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+			},
+			security: Bogus, infoCode: dns.ExtendedErrorCodeSignatureExpired,
+		},
+		{
+			name:  "unknown trust anchor",
+			qname: "www.example.", qtype: dns.TypeA,
+			setup: func(v *Validator) {
+				v.anchors = []*dns.DS{other.key.ToDS(dns.SHA256)}
+			},
+			security: Bogus, infoCode: dns.ExtendedErrorCodeDNSKEYMissing,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewValidator(h.anchors)
+			if tt.setup != nil {
+				tt.setup(v)
+			}
+			response := h.query(t, tt.qname, tt.qtype)
+			if tt.tamper != nil {
+				tt.tamper(response)
+			}
+
+			result := v.Validate(context.Background(), h.exchange, response)
+			if result.Security != tt.security {
+				t.Fatalf("got %s (%s), want %s", result.Security, result.Reason, tt.security)
+			}
+			if result.InfoCode != tt.infoCode {
+				t.Errorf("got info code %d, want %d", result.InfoCode, tt.infoCode)
+			}
+		})
+	}
+}
+
+func TestValidator_cachesKeys(t *testing.T) {
+	h := newTestHierarchy(t)
+	v := NewValidator(h.anchors)
+	queries := 0
+	exchange := func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		queries++
+		return h.exchange(ctx, msg)
+	}
+
+	if result := v.Validate(context.Background(), exchange, h.query(t, "www.example.", dns.TypeA)); result.Security != Secure {
+		t.Fatalf("got %s (%s), want secure", result.Security, result.Reason)
+	}
+	if queries == 0 {
+		t.Fatal("expected queries for the chain of trust")
+	}
+	queries = 0
+	if result := v.Validate(context.Background(), exchange, h.query(t, "missing.example.", dns.TypeA)); result.Security != Secure {
+		t.Fatalf("got %s (%s), want secure", result.Security, result.Reason)
+	}
+	if queries != 0 {
+		t.Errorf("got %d queries, want keys reused", queries)
+	}
+}
+
+func TestParseAnchors(t *testing.T) {
+	if anchors := RootAnchors(); len(anchors) != 2 {
+		t.Fatalf("got %d root anchors, want 2", len(anchors))
+	}
+	if _, err := ParseAnchors([]string{"example. IN DS 1 8 2 ABCD"}); err == nil {
+		t.Error("expected error for an anchor outside the root")
+	}
+	if _, err := ParseAnchors([]string{"not a record"}); err == nil {
+		t.Error("expected error for an invalid anchor")
+	}
+}
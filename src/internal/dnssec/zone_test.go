@@ -0,0 +1,261 @@
+package dnssec
+
+import (
+	"context"
+	"crypto"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is an authoritative zone signed with a single key, or unsigned
+// without one
+type testZone struct {
+	name    string
+	key     *dns.DNSKEY
+	signer  crypto.Signer
+	nsec3   bool
+	records []dns.RR
+}
+
+func newTestZone(t *testing.T, name string, signed, nsec3 bool, records ...string) *testZone {
+	t.Helper()
+	z := &testZone{name: name, nsec3: nsec3}
+	host := func(label string) string {
+		return dns.Fqdn(label + "." + strings.TrimSuffix(name, "."))
+	}
+	records = append([]string{name + " 300 IN SOA " + host("ns") + " " + host("hostmaster") + " 1 3600 600 86400 300"}, records...)
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.records = append(z.records, rr)
+	}
+	if signed {
+		z.key = &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     dns.ZONE | dns.SEP,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		private, err := z.key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.signer = private.(crypto.Signer)
+		z.records = append(z.records, z.key)
+	}
+	return z
+}
+
+// delegate adds the delegation of child, with DS records when it is signed
+func (z *testZone) delegate(child *testZone) {
+	ns, _ := dns.NewRR(child.name + " 3600 IN NS ns." + child.name)
+	z.records = append(z.records, ns)
+	if child.key != nil {
+		ds := child.key.ToDS(dns.SHA256)
+		ds.Hdr.Ttl = 3600
+		z.records = append(z.records, ds)
+	}
+}
+
+// finish adds the NSEC or NSEC3 chain and signs every set except
+// delegations
+func (z *testZone) finish(t *testing.T) {
+	t.Helper()
+	if z.key == nil {
+		return
+	}
+	types := make(map[string][]uint16)
+	var names []string
+	for _, rr := range z.records {
+		name := rr.Header().Name
+		if _, ok := types[name]; !ok {
+			names = append(names, name)
+		}
+		types[name] = append(types[name], rr.Header().Rrtype)
+	}
+	slices.SortFunc(names, compareNames)
+
+	if z.nsec3 {
+		hashes := make(map[string]string)
+		for _, name := range names {
+			hashes[dns.HashName(name, dns.SHA1, 0, "")] = name
+		}
+		sorted := make([]string, 0, len(hashes))
+		for hash := range hashes {
+			sorted = append(sorted, hash)
+		}
+		slices.Sort(sorted)
+		for i, hash := range sorted {
+			bitmap := append(slices.Clone(types[hashes[hash]]), dns.TypeRRSIG)
+			slices.Sort(bitmap)
+			z.records = append(z.records, &dns.NSEC3{
+				Hdr:        dns.RR_Header{Name: hash + "." + z.name, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+				Hash:       dns.SHA1,
+				HashLength: 20,
+				NextDomain: sorted[(i+1)%len(sorted)],
+				TypeBitMap: bitmap,
+			})
+		}
+	} else {
+		for i, name := range names {
+			bitmap := append(slices.Clone(types[name]), dns.TypeRRSIG, dns.TypeNSEC)
+			slices.Sort(bitmap)
+			z.records = append(z.records, &dns.NSEC{
+				Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+				NextDomain: names[(i+1)%len(names)],
+				TypeBitMap: slices.Compact(bitmap),
+			})
+		}
+	}
+
+	now := time.Now()
+	for _, set := range rrsets(z.records) {
+		if set.rrtype == dns.TypeNS && set.name != z.name {
+			continue
+		}
+		z.records = append(z.records, z.sign(t, set.rrs, now.Add(-time.Hour), now.Add(time.Hour)))
+	}
+}
+
+func (z *testZone) sign(t *testing.T, rrs []dns.RR, inception, expiration time.Time) *dns.RRSIG {
+	t.Helper()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrs[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		SignerName: z.name,
+		KeyTag:     z.key.KeyTag(),
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(z.signer, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// lookup returns the records of name and rrtype with their signatures
+func (z *testZone) lookup(name string, rrtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.records {
+		if rr.Header().Name != name {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); rr.Header().Rrtype == rrtype || ok && sig.TypeCovered == rrtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+func (z *testZone) exists(name string) bool {
+	return slices.ContainsFunc(z.records, func(rr dns.RR) bool { return dns.IsSubDomain(name, rr.Header().Name) })
+}
+
+// denial returns the SOA and every NSEC or NSEC3 record with their
+// signatures
+func (z *testZone) denial() []dns.RR {
+	rrs := z.lookup(z.name, dns.TypeSOA)
+	for _, rrtype := range []uint16{dns.TypeNSEC, dns.TypeNSEC3} {
+		for _, rr := range z.records {
+			if sig, ok := rr.(*dns.RRSIG); rr.Header().Rrtype == rrtype || ok && sig.TypeCovered == rrtype {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	return rrs
+}
+
+// testHierarchy answers queries from a set of zones like a resolver that
+// does not validate
+type testHierarchy struct {
+	zones   map[string]*testZone
+	anchors []*dns.DS
+}
+
+// newTestHierarchy builds a signed root delegating to example. signed with
+// NSEC, nsec3. signed with NSEC3 and the unsigned insecure.
+func newTestHierarchy(t *testing.T) *testHierarchy {
+	t.Helper()
+	root := newTestZone(t, ".", true, false)
+	example := newTestZone(t, "example.", true, false,
+		"www.example. 300 IN A 192.0.2.1",
+		"alias.example. 300 IN CNAME www.example.",
+		"*.wild.example. 300 IN A 192.0.2.2",
+	)
+	nsec3 := newTestZone(t, "nsec3.", true, true, "www.nsec3. 300 IN A 192.0.2.4")
+	insecure := newTestZone(t, "insecure.", false, false, "www.insecure. 300 IN A 192.0.2.3")
+	root.delegate(example)
+	root.delegate(nsec3)
+	root.delegate(insecure)
+
+	h := &testHierarchy{
+		zones:   make(map[string]*testZone),
+		anchors: []*dns.DS{root.key.ToDS(dns.SHA256)},
+	}
+	for _, z := range []*testZone{root, example, nsec3, insecure} {
+		z.finish(t)
+		h.zones[z.name] = z
+	}
+	return h
+}
+
+// zoneFor returns the zone answering for name. DS records are answered by
+// the parent of a zone.
+func (h *testHierarchy) zoneFor(name string, qtype uint16) *testZone {
+	for n := name; ; n = parent(n) {
+		if z, ok := h.zones[n]; ok && (qtype != dns.TypeDS || n != name || n == ".") {
+			return z
+		}
+		if n == "." {
+			return h.zones["."]
+		}
+	}
+}
+
+func (h *testHierarchy) exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	question := msg.Question[0]
+	name := canonical(question.Name)
+	z := h.zoneFor(name, question.Qtype)
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	response.Authoritative = true
+
+	if rrs := z.lookup(name, question.Qtype); len(rrs) > 0 {
+		response.Answer = rrs
+		return response, nil
+	}
+	if rrs := z.lookup(name, dns.TypeCNAME); len(rrs) > 0 {
+		response.Answer = append(rrs, z.lookup(rrs[0].(*dns.CNAME).Target, question.Qtype)...)
+		return response, nil
+	}
+	if !z.exists(name) {
+		if rrs := z.lookup("*."+parent(name), question.Qtype); len(rrs) > 0 {
+			for _, rr := range rrs {
+				rr = dns.Copy(rr)
+				rr.Header().Name = question.Name
+				response.Answer = append(response.Answer, rr)
+			}
+			response.Ns = z.denial()
+			return response, nil
+		}
+		response.Rcode = dns.RcodeNameError
+	}
+	response.Ns = z.denial()
+	return response, nil
+}
+
+// query asks the hierarchy for name and qtype with DNSSEC records
+func (h *testHierarchy) query(t *testing.T, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	response, err := lookup(context.Background(), h.exchange, name, qtype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
@@ -2,25 +2,46 @@ package dot
 
 import (
 	"context"
+	"encoding/binary"
+	"io"
 	"log/slog"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/quaintdev/webshield/src/internal/service"
 
 	"github.com/miekg/dns"
 )
 
+const (
+	// idleTimeout closes connections without queries, as the dns package
+	// does for the connections it serves
+	idleTimeout = 8 * time.Second
+	// maxConnQueries bounds the queries of a connection answered at once
+	maxConnQueries = 64
+)
+
+// queryProcessor answers queries, *service.DNSService outside of tests
+type queryProcessor interface {
+	ProcessQuery(ctx context.Context, msg *dns.Msg, configId string) (*dns.Msg, error)
+}
+
 type DNSHandler struct {
-	dnsService *service.DNSService
+	dnsService queryProcessor
 	listener   *Listener
 }
 
-func NewDNSHandler(dnsService *service.DNSService, listener *Listener) *DNSHandler {
+func NewDNSHandler(dnsService queryProcessor, listener *Listener) *DNSHandler {
 	return &DNSHandler{
 		dnsService: dnsService,
 		listener:   listener,
 	}
 }
 
+// HandleQuery takes over the connection of the first query. The dns package
+// answers the queries of a connection one after the other, so a delayed
+// query would hold up every query sent after it.
 func (h *DNSHandler) HandleQuery(ctx context.Context) func(w dns.ResponseWriter, r *dns.Msg) {
 	return func(w dns.ResponseWriter, r *dns.Msg) {
 		var serverName string
@@ -28,14 +49,91 @@ func (h *DNSHandler) HandleQuery(ctx context.Context) func(w dns.ResponseWriter,
 			slog.Debug("fetched server name", "server", sni)
 			serverName = sni
 		}
-		response, err := h.dnsService.ProcessQuery(ctx, r, serverName)
-		if err != nil {
-			slog.Error("error occurred while processing request")
+		ctx := service.WithClientAddr(ctx, service.ParseClientAddr(w.RemoteAddr().String()))
+		conn, ok := h.listener.conn(w.RemoteAddr().String())
+		if !ok {
+			h.answer(ctx, r, serverName, w.WriteMsg)
 			return
 		}
-		// Write the response back to the client
-		if err := w.WriteMsg(response); err != nil {
-			slog.Error("failed to write DNS response", "error", err)
+		w.Hijack()
+		h.serveConn(ctx, conn, r, serverName)
+	}
+}
+
+// serveConn answers the queries of conn concurrently, starting with first.
+// The connection is closed once the client stops sending queries and every
+// query is answered.
+func (h *DNSHandler) serveConn(ctx context.Context, conn net.Conn, first *dns.Msg, serverName string) {
+	defer conn.Close()
+	// unblock the read below on shutdown
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	var writeMu sync.Mutex
+	write := func(response *dns.Msg) error {
+		data, err := response.Pack()
+		if err != nil {
+			return err
 		}
+		msg := make([]byte, 2+len(data))
+		binary.BigEndian.PutUint16(msg, uint16(len(data)))
+		copy(msg[2:], data)
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_, err = conn.Write(msg)
+		return err
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxConnQueries)
+	serve := func(r *dns.Msg) {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			h.answer(ctx, r, serverName, write)
+		}()
+	}
+
+	serve(first)
+	for ctx.Err() == nil {
+		buf, err := readQuery(conn)
+		if err != nil {
+			break
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(buf); err != nil {
+			slog.Debug("ignoring malformed query", "error", err)
+			continue
+		}
+		serve(r)
+	}
+	wg.Wait()
+}
+
+// readQuery reads the next length prefixed query of conn
+func readQuery(conn net.Conn) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (h *DNSHandler) answer(ctx context.Context, r *dns.Msg, serverName string, write func(*dns.Msg) error) {
+	response, err := h.dnsService.ProcessQuery(ctx, r, serverName)
+	if err != nil {
+		slog.Error("error occurred while processing request")
+		return
+	}
+	// Write the response back to the client
+	if err := write(response); err != nil {
+		slog.Error("failed to write DNS response", "error", err)
 	}
 }
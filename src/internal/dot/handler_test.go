@@ -0,0 +1,121 @@
+package dot
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// delayingProcessor answers slow.example. after delay and every other name
+// at once
+type delayingProcessor struct {
+	delay time.Duration
+}
+
+func (p delayingProcessor) ProcessQuery(ctx context.Context, msg *dns.Msg, _ string) (*dns.Msg, error) {
+	if msg.Question[0].Name == "slow.example." {
+		select {
+		case <-time.After(p.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	return response, nil
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example"},
+		DNSNames:     []string{"dns.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// startDoT serves processor over DoT and returns the address of the server
+func startDoT(t *testing.T, processor queryProcessor) string {
+	t.Helper()
+	tlsConfig := testTLSConfig(t)
+	baseListener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	listener := &Listener{Listener: baseListener}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          listener,
+		TLSConfig:         tlsConfig,
+		Handler:           dns.HandlerFunc(NewDNSHandler(processor, listener).HandleQuery(ctx)),
+		Net:               "tcp-tls",
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() {
+		cancel()
+		server.Shutdown()
+	})
+	return baseListener.Addr().String()
+}
+
+func TestDNSHandler_delayedQueryDoesNotHoldUpConnection(t *testing.T) {
+	address := startDoT(t, delayingProcessor{delay: time.Second})
+	conn, err := dns.DialWithTLS("tcp", address, &tls.Config{InsecureSkipVerify: true, ServerName: "dns.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	slow := new(dns.Msg)
+	slow.SetQuestion("slow.example.", dns.TypeA)
+	fast := new(dns.Msg)
+	fast.SetQuestion("fast.example.", dns.TypeA)
+	start := time.Now()
+	for _, msg := range []*dns.Msg{slow, fast} {
+		if err := conn.WriteMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	first, err := conn.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Id != fast.Id {
+		t.Errorf("first answer is for %s, want the query sent after the delayed one", first.Question[0].Name)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("query took %v behind a delayed query, want it answered promptly", elapsed)
+	}
+	second, err := conn.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Id != slow.Id {
+		t.Errorf("second answer is for %s, want the delayed query answered on the same connection", second.Question[0].Name)
+	}
+}
@@ -53,14 +53,29 @@ func (l *Listener) Accept() (net.Conn, error) {
 	hostname := "." + os.Getenv("hostname")
 	serverName = strings.ReplaceAll(serverName, hostname, "")
 	slog.Debug("Adding", "key", key, "serverName", serverName, "hostname", hostname)
-	l.connections.Store(key, serverName)
+	l.connections.Store(key, trackedEntry{conn: wrapped, serverName: serverName})
 	return wrapped, nil
 }
 
+// trackedEntry is what the listener knows about an accepted connection
+type trackedEntry struct {
+	conn       net.Conn
+	serverName string
+}
+
 func (l *Listener) GetServerName(remoteAddr string) (string, bool) {
 	val, ok := l.connections.Load(remoteAddr)
 	if !ok {
 		return "", false
 	}
-	return val.(string), true
+	return val.(trackedEntry).serverName, true
+}
+
+// conn returns the accepted connection of the client at remoteAddr
+func (l *Listener) conn(remoteAddr string) (net.Conn, bool) {
+	val, ok := l.connections.Load(remoteAddr)
+	if !ok {
+		return nil, false
+	}
+	return val.(trackedEntry).conn, true
 }
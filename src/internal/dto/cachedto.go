@@ -0,0 +1,24 @@
+package dto
+
+import "time"
+
+type CacheStats struct {
+	Entries      int    `json:"entries"`
+	Capacity     int    `json:"capacity"`
+	Hits         uint64 `json:"hits"`
+	Misses       uint64 `json:"misses"`
+	Evictions    uint64 `json:"evictions"`
+	StaleAnswers uint64 `json:"staleAnswers"`
+	Prefetches   uint64 `json:"prefetches"`
+}
+
+type CacheEntry struct {
+	Key       string    `json:"key"`
+	Type      string    `json:"type"`
+	Rcode     string    `json:"rcode"`
+	Answer    []string  `json:"answer"`
+	CachedAt  time.Time `json:"cachedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Stale     bool      `json:"stale"`
+	Hits      int64     `json:"hits"`
+}
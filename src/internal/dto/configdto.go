@@ -2,14 +2,21 @@ package dto
 
 import (
 	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/quaintdev/webshield/src/internal/entity"
 )
 
 type Category struct {
 	Name   string `json:"name"`
-	Status string `json:"status"` // "allowed", "blocked", or "inactive"
+	Status string `json:"status"` // "active", "blocked", "warn", "delay" or "inactive"
 }
 
 type Schedule struct {
@@ -18,6 +25,24 @@ type Schedule struct {
 	EndTime   string `json:"endTime"`   // Format: "HH:MM"
 }
 
+type BlockResponse struct {
+	Mode string `json:"mode"` // "nxdomain", "nodata", "refused", "nullip" or "customip"
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+	TTL  uint32 `json:"ttl,omitempty"`
+}
+
+type QTypePolicy struct {
+	Type    string `json:"type"`   // e.g. "AAAA", "HTTPS" or "TYPE65"
+	Action  string `json:"action"` // "refuse" or "empty"
+	MaxSize int    `json:"maxSize,omitempty"`
+}
+
+type ForwardingRule struct {
+	Domain  string   `json:"domain"`  // e.g. "corp.example" or "*.lan"
+	Servers []string `json:"servers"` // e.g. "10.0.0.53" or "10.0.0.53:5353"
+}
+
 type AddPresetRequest struct {
 	Email string `json:"-"`
 	ConfigFields
@@ -28,11 +53,29 @@ type PresetResponse struct {
 }
 
 type ConfigFields struct {
-	PresetName string     `json:"name"`
-	Enabled    bool       `json:"enabled"`
-	UTCOffset  int        `json:"offset"`
-	Categories []Category `json:"categories"`
-	Schedule   []Schedule `json:"schedule"`
+	PresetName   string     `json:"name"`
+	Enabled      bool       `json:"enabled"`
+	UTCOffset    int        `json:"offset"`
+	Categories   []Category `json:"categories"`
+	Schedule     []Schedule `json:"schedule"`
+	SafeSearch   bool       `json:"safeSearch"`
+	BlockBypass  bool       `json:"blockBypass"`
+	InspectCNAME bool       `json:"inspectCname"`
+
+	RebindingProtection bool     `json:"rebindingProtection"`
+	BlockedIPRanges     []string `json:"blockedIpRanges"`
+
+	QTypePolicies []QTypePolicy `json:"qtypePolicies"`
+
+	ForwardingRules []ForwardingRule `json:"forwardingRules"`
+	UpstreamGroup   string           `json:"upstreamGroup"`
+
+	BlockResponse          BlockResponse            `json:"blockResponse"`
+	CategoryBlockResponses map[string]BlockResponse `json:"categoryBlockResponses"`
+
+	SoftBlockMinutes      int `json:"softBlockMinutes"`
+	DelaySeconds          int `json:"delaySeconds"`
+	DelayIncrementSeconds int `json:"delayIncrementSeconds"`
 }
 
 func MakePresetResponse(config *entity.Settings) *PresetResponse {
@@ -40,6 +83,26 @@ func MakePresetResponse(config *entity.Settings) *PresetResponse {
 	response.PresetName = config.Name
 	response.PresetID = config.ID
 	response.Enabled = config.Enabled
+	response.SafeSearch = config.SafeSearch
+	response.BlockBypass = config.BlockBypass
+	response.InspectCNAME = config.InspectCNAME
+	response.RebindingProtection = config.RebindingProtection
+	response.BlockedIPRanges = config.BlockedIPRanges
+	response.BlockResponse = makeBlockResponseDTO(config.DefaultBlockResponse)
+	if len(config.BlockResponses) > 0 {
+		response.CategoryBlockResponses = make(map[string]BlockResponse)
+		for k, v := range config.BlockResponses {
+			response.CategoryBlockResponses[k] = makeBlockResponseDTO(v)
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(config.QTypePolicies)) {
+		v := config.QTypePolicies[k]
+		response.QTypePolicies = append(response.QTypePolicies, QTypePolicy{
+			Type:    dns.Type(k).String(),
+			Action:  string(v.Action),
+			MaxSize: v.MaxSize,
+		})
+	}
 	for k, v := range config.Categories {
 		var category Category
 		category.Name = k
@@ -50,10 +113,24 @@ func MakePresetResponse(config *entity.Settings) *PresetResponse {
 			category.Status = "blocked"
 		case entity.Blue:
 			category.Status = "active"
+		case entity.Yellow:
+			category.Status = "warn"
+		case entity.Orange:
+			category.Status = "delay"
 		}
 		response.Categories = append(response.Categories, category)
 	}
+	for _, v := range config.ForwardingRules {
+		response.ForwardingRules = append(response.ForwardingRules, ForwardingRule{
+			Domain:  v.Domain,
+			Servers: v.Servers,
+		})
+	}
+	response.UpstreamGroup = config.UpstreamGroup
 	response.UTCOffset = config.UTCOffset
+	response.SoftBlockMinutes = config.SoftBlockMinutes
+	response.DelaySeconds = config.DelaySeconds
+	response.DelayIncrementSeconds = config.DelayIncrementSeconds
 	for k, v := range config.WeekDayScheduleMap {
 		var schedule Schedule
 		schedule.Day = k.String()
@@ -74,7 +151,22 @@ func MakeConfig(req *UpdatePresetRequest) *entity.Settings {
 	config.Name = req.PresetName
 	config.ID = req.PresetID
 	config.Enabled = req.Enabled
+	config.SafeSearch = req.SafeSearch
+	config.BlockBypass = req.BlockBypass
+	config.InspectCNAME = req.InspectCNAME
+	config.RebindingProtection = req.RebindingProtection
+	for _, v := range req.BlockedIPRanges {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			slog.Error("Failed to parse blocked ip range", "range", v)
+			continue
+		}
+		config.BlockedIPRanges = append(config.BlockedIPRanges, prefix.Masked().String())
+	}
 	config.UTCOffset = req.UTCOffset
+	config.SoftBlockMinutes = req.SoftBlockMinutes
+	config.DelaySeconds = req.DelaySeconds
+	config.DelayIncrementSeconds = req.DelayIncrementSeconds
 	config.Categories = make(map[string]entity.Category)
 	config.WeekDayScheduleMap = make(map[time.Weekday]entity.Schedule)
 	for _, v := range req.Categories {
@@ -85,8 +177,41 @@ func MakeConfig(req *UpdatePresetRequest) *entity.Settings {
 			config.Categories[v.Name] = entity.Black
 		case "active":
 			config.Categories[v.Name] = entity.Blue
+		case "warn":
+			config.Categories[v.Name] = entity.Yellow
+		case "delay":
+			config.Categories[v.Name] = entity.Orange
+		}
+	}
+	if block, ok := makeBlockResponse(req.BlockResponse); ok {
+		config.DefaultBlockResponse = block
+	}
+	config.BlockResponses = make(map[string]entity.BlockResponse)
+	for k, v := range req.CategoryBlockResponses {
+		if block, ok := makeBlockResponse(v); ok {
+			config.BlockResponses[k] = block
+		}
+	}
+	config.QTypePolicies = make(map[uint16]entity.QTypePolicy)
+	for _, v := range req.QTypePolicies {
+		qtype, ok := parseQType(v.Type)
+		if !ok {
+			slog.Error("Failed to parse query type", "type", v.Type)
+			continue
+		}
+		switch entity.QTypeAction(v.Action) {
+		case entity.QTypeRefuse, entity.QTypeEmpty:
+			config.QTypePolicies[qtype] = entity.QTypePolicy{Action: entity.QTypeAction(v.Action), MaxSize: v.MaxSize}
+		default:
+			slog.Error("Unknown query type action", "action", v.Action)
+		}
+	}
+	for _, v := range req.ForwardingRules {
+		if rule, ok := makeForwardingRule(v); ok {
+			config.ForwardingRules = append(config.ForwardingRules, rule)
 		}
 	}
+	config.UpstreamGroup = req.UpstreamGroup
 	now := time.Now().UTC()
 	for _, v := range req.Schedule {
 		startHrMin, err := time.Parse("15:04", v.StartTime)
@@ -115,6 +240,76 @@ func MakeConfig(req *UpdatePresetRequest) *entity.Settings {
 	return config
 }
 
+func makeBlockResponseDTO(block entity.BlockResponse) BlockResponse {
+	mode := block.Mode
+	if mode == "" {
+		mode = entity.BlockNXDomain
+	}
+	return BlockResponse{
+		Mode: string(mode),
+		IPv4: block.IPv4,
+		IPv6: block.IPv6,
+		TTL:  block.TTL,
+	}
+}
+
+func makeBlockResponse(req BlockResponse) (entity.BlockResponse, bool) {
+	block := entity.BlockResponse{Mode: entity.BlockMode(req.Mode), TTL: req.TTL}
+	switch block.Mode {
+	case "", entity.BlockNXDomain, entity.BlockNoData, entity.BlockRefused, entity.BlockNullIP:
+	case entity.BlockCustomIP:
+		if ip := net.ParseIP(req.IPv4); ip != nil && ip.To4() != nil {
+			block.IPv4 = ip.String()
+		}
+		if ip := net.ParseIP(req.IPv6); ip != nil && ip.To4() == nil {
+			block.IPv6 = ip.String()
+		}
+		if block.IPv4 == "" && block.IPv6 == "" {
+			slog.Error("Block response requires an ip address", "ipv4", req.IPv4, "ipv6", req.IPv6)
+			return block, false
+		}
+	default:
+		slog.Error("Unknown block mode", "mode", req.Mode)
+		return block, false
+	}
+	return block, true
+}
+
+func makeForwardingRule(req ForwardingRule) (entity.ForwardingRule, bool) {
+	domain, ok := normalizeDomainPattern(req.Domain)
+	if !ok {
+		slog.Error("Failed to parse forwarding domain", "domain", req.Domain)
+		return entity.ForwardingRule{}, false
+	}
+	rule := entity.ForwardingRule{Domain: domain}
+	for _, server := range req.Servers {
+		if addrPort, err := netip.ParseAddrPort(server); err == nil {
+			rule.Servers = append(rule.Servers, addrPort.String())
+		} else if addr, err := netip.ParseAddr(server); err == nil {
+			rule.Servers = append(rule.Servers, addr.String())
+		} else {
+			slog.Error("Failed to parse forwarding server", "server", server)
+		}
+	}
+	if len(rule.Servers) == 0 {
+		slog.Error("Forwarding rule requires a server", "domain", req.Domain)
+		return rule, false
+	}
+	return rule, true
+}
+
+// parseQType accepts type mnemonics as well as the generic TYPEnn notation
+func parseQType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	if qtype, ok := dns.StringToType[s]; ok {
+		return qtype, true
+	}
+	if qtype, err := strconv.ParseUint(strings.TrimPrefix(s, "TYPE"), 10, 16); err == nil {
+		return uint16(qtype), true
+	}
+	return 0, false
+}
+
 func convertDayStrToWeekday(day string) time.Weekday {
 	var weekday time.Weekday
 	switch day {
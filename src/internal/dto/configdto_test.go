@@ -37,3 +37,47 @@ func TestMakePresetResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestMakePresetResponse_qtypePolicies(t *testing.T) {
+	// map order must not leak into the response
+	config := &entity.Settings{
+		QTypePolicies: map[uint16]entity.QTypePolicy{
+			65:  {Action: entity.QTypeEmpty},
+			16:  {Action: entity.QTypeRefuse, MaxSize: 512},
+			255: {Action: entity.QTypeRefuse},
+			28:  {Action: entity.QTypeEmpty},
+		},
+	}
+	want := []string{"TXT", "AAAA", "HTTPS", "ANY"}
+	for range 5 {
+		var got []string
+		for _, policy := range MakePresetResponse(config).QTypePolicies {
+			got = append(got, policy.Type)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("MakePresetResponse() qtype policies = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestParseQType(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		want   uint16
+		wantOk bool
+	}{
+		{name: "mnemonic", input: "AAAA", want: 28, wantOk: true},
+		{name: "lowercase mnemonic", input: "https", want: 65, wantOk: true},
+		{name: "generic notation", input: "TYPE64", want: 64, wantOk: true},
+		{name: "unknown", input: "BOGUS", want: 0, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseQType(tt.input)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("parseQType() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
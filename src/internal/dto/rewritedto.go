@@ -0,0 +1,89 @@
+package dto
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/apperrors"
+	"github.com/quaintdev/webshield/src/internal/entity"
+)
+
+type Rewrite struct {
+	Domain string `json:"domain"` // e.g. "printer.home" or "*.dev.local"
+	Type   string `json:"type"`   // "A", "AAAA" or "CNAME"
+	Value  string `json:"value"`  // address or CNAME target
+}
+
+func MakeRewritesResponse(rewrites []entity.Rewrite) []Rewrite {
+	response := make([]Rewrite, 0, len(rewrites))
+	for _, v := range rewrites {
+		response = append(response, Rewrite{
+			Domain: v.Domain,
+			Type:   dns.Type(v.Type).String(),
+			Value:  v.Value,
+		})
+	}
+	return response
+}
+
+// MakeRewrites validates and normalizes the rewrites of a preset
+func MakeRewrites(req []Rewrite) ([]entity.Rewrite, error) {
+	rewrites := make([]entity.Rewrite, 0, len(req))
+	types := make(map[string][]uint16)
+	for _, v := range req {
+		domain, ok := normalizeDomainPattern(v.Domain)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid domain %q", apperrors.ErrInvalidInput, v.Domain)
+		}
+		qtype, _ := parseQType(v.Type)
+		rewrite := entity.Rewrite{Domain: domain, Type: qtype}
+		switch qtype {
+		case dns.TypeA:
+			addr, err := netip.ParseAddr(v.Value)
+			if err != nil || !addr.Is4() {
+				return nil, fmt.Errorf("%w: invalid ipv4 address %q", apperrors.ErrInvalidInput, v.Value)
+			}
+			rewrite.Value = addr.String()
+		case dns.TypeAAAA:
+			addr, err := netip.ParseAddr(v.Value)
+			if err != nil || !addr.Is6() || addr.Is4In6() {
+				return nil, fmt.Errorf("%w: invalid ipv6 address %q", apperrors.ErrInvalidInput, v.Value)
+			}
+			rewrite.Value = addr.String()
+		case dns.TypeCNAME:
+			target := strings.ToLower(strings.TrimSuffix(v.Value, "."))
+			if _, ok := dns.IsDomainName(target); !ok || target == "" || strings.Contains(target, "*") {
+				return nil, fmt.Errorf("%w: invalid target %q", apperrors.ErrInvalidInput, v.Value)
+			}
+			rewrite.Value = target
+		default:
+			return nil, fmt.Errorf("%w: unsupported record type %q", apperrors.ErrInvalidInput, v.Type)
+		}
+
+		// a CNAME cannot coexist with other records of the same name
+		for _, existing := range types[domain] {
+			if existing == dns.TypeCNAME || qtype == dns.TypeCNAME {
+				return nil, fmt.Errorf("%w: CNAME for %q conflicts with other records", apperrors.ErrInvalidInput, domain)
+			}
+		}
+		types[domain] = append(types[domain], qtype)
+		rewrites = append(rewrites, rewrite)
+	}
+	return rewrites, nil
+}
+
+// normalizeDomainPattern lowercases domain and strips the trailing period.
+// A leading "*." label is the only wildcard allowed.
+func normalizeDomainPattern(domain string) (string, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	name := strings.TrimPrefix(domain, "*.")
+	if name == "" || strings.Contains(name, "*") {
+		return "", false
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", false
+	}
+	return domain, true
+}
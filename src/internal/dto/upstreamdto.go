@@ -0,0 +1,18 @@
+package dto
+
+import "time"
+
+type UpstreamStatus struct {
+	Address             string     `json:"address"`
+	Group               string     `json:"group,omitempty"`
+	Forwarding          string     `json:"forwarding,omitempty"`
+	Healthy             bool       `json:"healthy"`
+	Drained             bool       `json:"drained"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	Successes           uint64     `json:"successes"`
+	Failures            uint64     `json:"failures"`
+	LatencyMs           float64    `json:"latencyMs"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure         *time.Time `json:"lastFailure,omitempty"`
+}
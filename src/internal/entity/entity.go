@@ -8,6 +8,27 @@ const (
 	White Category = "white"
 	Blue  Category = "blue"
 	Black Category = "black"
+	// Yellow categories show an interstitial before allowing access
+	Yellow Category = "yellow"
+	// Orange categories resolve normally after an artificial delay
+	Orange Category = "orange"
+)
+
+type BlockMode string
+
+const (
+	BlockNXDomain BlockMode = "nxdomain"
+	BlockNoData   BlockMode = "nodata"
+	BlockRefused  BlockMode = "refused"
+	BlockNullIP   BlockMode = "nullip"
+	BlockCustomIP BlockMode = "customip"
+)
+
+type QTypeAction string
+
+const (
+	QTypeRefuse QTypeAction = "refuse"
+	QTypeEmpty  QTypeAction = "empty"
 )
 
 type User struct {
@@ -23,12 +44,103 @@ type Settings struct {
 	Enabled bool
 
 	Categories map[string]Category
+	// SoftBlockMinutes is how long a yellow domain stays allowed after the
+	// user clicked through the interstitial
+	SoftBlockMinutes int
+	// DelaySeconds is the delay of the first daily visit to an orange
+	// domain, every further visit adds DelayIncrementSeconds
+	DelaySeconds          int
+	DelayIncrementSeconds int
+
+	// SafeSearch rewrites search engine and YouTube hostnames to their
+	// restricted endpoints
+	SafeSearch bool
+	// BlockBypass blocks public DoH/DoT resolvers, browser canary domains
+	// and strips ECH configs from HTTPS/SVCB records
+	BlockBypass bool
+	// InspectCNAME blocks responses whose CNAME chain contains a blocked
+	// domain
+	InspectCNAME bool
+	// RebindingProtection blocks public names resolving to private,
+	// loopback or link-local addresses
+	RebindingProtection bool
+	// BlockedIPRanges are CIDR ranges that answers must not point into
+	BlockedIPRanges []string
+
+	// DefaultBlockResponse is sent for blocked domains unless the category
+	// has its own entry in BlockResponses
+	DefaultBlockResponse BlockResponse
+	BlockResponses       map[string]BlockResponse
+
+	// QTypePolicies overrides how queries are answered per question type
+	QTypePolicies map[uint16]QTypePolicy
+
+	// ForwardingRules send matching domains to their own servers ahead of
+	// the global rules
+	ForwardingRules []ForwardingRule
+	// UpstreamGroup names the group of config.json resolving the queries
+	// of the preset, the default servers are used when empty
+	UpstreamGroup string
 
 	WeekDayScheduleMap map[time.Weekday]Schedule
 	UTCOffset          int
 }
 
+// BlockResponse describes the answer sent for blocked domains
+type BlockResponse struct {
+	Mode BlockMode
+	// IPv4 and IPv6 are answered in BlockCustomIP mode
+	IPv4 string
+	IPv6 string
+	// TTL of the answer or of the SOA sent with negative answers
+	TTL uint32
+}
+
+// QTypePolicy answers queries of a type with Action instead of resolving them
+type QTypePolicy struct {
+	Action QTypeAction
+	// MaxSize applies the policy only to responses larger than MaxSize bytes
+	MaxSize int
+}
+
 type Schedule struct {
 	StartTime time.Time
 	EndTime   time.Time
 }
+
+// Rewrite is a local record answered authoritatively for a preset. Domain
+// may start with "*." to match every subdomain.
+type Rewrite struct {
+	Domain string
+	// Type is the record type, one of A, AAAA or CNAME
+	Type uint16
+	// Value is the address or, for CNAME records, the target name
+	Value string
+}
+
+// ForwardingRule sends queries for Domain and its subdomains to Servers.
+// A "*." prefix matches subdomains only.
+type ForwardingRule struct {
+	Domain string
+	// Servers are ip addresses with an optional port, 53 by default
+	Servers []string
+}
+
+// Upstream is a DNS server queries are forwarded to
+type Upstream struct {
+	Address string
+	// Drained upstreams stay configured but receive no queries
+	Drained bool
+}
+
+// CacheEntry is a cached DNS answer kept across restarts
+type CacheEntry struct {
+	Key string
+	// Response is the answer in wire format
+	Response  []byte
+	CachedAt  time.Time
+	ExpiresAt time.Time
+	// KeepUntil is when the entry leaves the cache, past ExpiresAt when
+	// stale answers are served
+	KeepUntil time.Time
+}
@@ -2,7 +2,9 @@ package repository
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"time"
@@ -23,7 +25,7 @@ func NewBoltDataStore(dbPath string) (*BoltDataStore, error) {
 		return nil, fmt.Errorf("could not open db: %v", err)
 	}
 	err = db.Update(func(tx *bbolt.Tx) error {
-		for _, bucket := range []string{"users", "configs"} {
+		for _, bucket := range []string{"users", "configs", "rewrites", "upstreams", "cache"} {
 			_, err := tx.CreateBucketIfNotExists([]byte(bucket))
 			if err != nil {
 				return fmt.Errorf("could not create bucket %s: %v", bucket, err)
@@ -109,3 +111,129 @@ func (u *BoltDataStore) GetAllConfigs(ctx context.Context) ([]*entity.Settings,
 	}
 	return configs, nil
 }
+
+//Rewrite repository impl
+
+func (u *BoltDataStore) GetRewrites(ctx context.Context, configId string) ([]entity.Rewrite, error) {
+	var rewrites []entity.Rewrite
+	err := u.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("rewrites"))
+		rewriteData := bucket.Get([]byte(configId))
+		if rewriteData == nil {
+			return nil
+		}
+		err := json.Unmarshal(rewriteData, &rewrites)
+		if err != nil {
+			slog.Error("error unmarshalling read rewrites", "configId", configId)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rewrites, nil
+}
+
+func (u *BoltDataStore) UpdateRewrites(ctx context.Context, configId string, rewrites []entity.Rewrite) error {
+	return u.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("rewrites"))
+		rewriteData, err := json.Marshal(rewrites)
+		if err != nil {
+			slog.Error("failing to marshal while saving to db", "error", err)
+			return err
+		}
+		return bucket.Put([]byte(configId), rewriteData)
+	})
+}
+
+func (u *BoltDataStore) DeleteRewrites(ctx context.Context, configId string) error {
+	slog.Debug("deleting rewrites from db", "configId", configId)
+	return u.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("rewrites"))
+		return bucket.Delete([]byte(configId))
+	})
+}
+
+//Upstream repository impl
+
+func (u *BoltDataStore) GetUpstreams(ctx context.Context) ([]entity.Upstream, error) {
+	var upstreams []entity.Upstream
+	err := u.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("upstreams"))
+		upstreamData := bucket.Get([]byte("servers"))
+		if upstreamData == nil {
+			return nil
+		}
+		err := json.Unmarshal(upstreamData, &upstreams)
+		if err != nil {
+			slog.Error("error unmarshalling read upstreams")
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return upstreams, nil
+}
+
+func (u *BoltDataStore) UpdateUpstreams(ctx context.Context, upstreams []entity.Upstream) error {
+	return u.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("upstreams"))
+		upstreamData, err := json.Marshal(upstreams)
+		if err != nil {
+			slog.Error("failing to marshal while saving to db", "error", err)
+			return err
+		}
+		return bucket.Put([]byte("servers"), upstreamData)
+	})
+}
+
+//Cache repository impl
+
+func (u *BoltDataStore) GetCacheEntries(ctx context.Context) ([]entity.CacheEntry, error) {
+	var entries []entity.CacheEntry
+	err := u.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("cache"))
+		return bucket.ForEach(func(key, entryData []byte) error {
+			var entry entity.CacheEntry
+			if err := json.Unmarshal(entryData, &entry); err != nil {
+				// a broken entry only costs its own answer
+				slog.Warn("skipping unreadable cache entry", "error", err)
+				return nil
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ReplaceCacheEntries stores every entry under its own key, numbered so that
+// they are read back in order
+func (u *BoltDataStore) ReplaceCacheEntries(ctx context.Context, entries []entity.CacheEntry) error {
+	return u.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket([]byte("cache")); err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+			return err
+		}
+		bucket, err := tx.CreateBucket([]byte("cache"))
+		if err != nil {
+			return err
+		}
+		for i, entry := range entries {
+			entryData, err := json.Marshal(entry)
+			if err != nil {
+				slog.Error("failing to marshal while saving to db", "error", err)
+				return err
+			}
+			if err := bucket.Put(binary.BigEndian.AppendUint64(nil, uint64(i)), entryData); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -18,3 +18,19 @@ type SettingsRepository interface {
 	DeleteConfig(ctx context.Context, config string) error
 	GetAllConfigs(ctx context.Context) ([]*entity.Settings, error)
 }
+
+type RewriteRepository interface {
+	GetRewrites(ctx context.Context, configId string) ([]entity.Rewrite, error)
+	UpdateRewrites(ctx context.Context, configId string, rewrites []entity.Rewrite) error
+	DeleteRewrites(ctx context.Context, configId string) error
+}
+
+type UpstreamRepository interface {
+	GetUpstreams(ctx context.Context) ([]entity.Upstream, error)
+	UpdateUpstreams(ctx context.Context, upstreams []entity.Upstream) error
+}
+
+type CacheRepository interface {
+	GetCacheEntries(ctx context.Context) ([]entity.CacheEntry, error)
+	ReplaceCacheEntries(ctx context.Context, entries []entity.CacheEntry) error
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/entity"
+)
+
+const (
+	// defaultBlockTTL is used when a block response has no TTL configured
+	defaultBlockTTL = 60
+
+	soaNameServer = "ns.webshield."
+	soaMailbox    = "hostmaster.webshield."
+)
+
+// blockResponseFor returns the block response configured for category
+func blockResponseFor(config *entity.Settings, category string) entity.BlockResponse {
+	if category == bypassCategory {
+		// the DoH canary has to answer NXDOMAIN for browsers to turn DoH off
+		return entity.BlockResponse{Mode: entity.BlockNXDomain}
+	}
+	if block, ok := config.BlockResponses[category]; ok {
+		return block
+	}
+	return config.DefaultBlockResponse
+}
+
+// blockedResponse builds the reply for a blocked query as per block mode
+func blockedResponse(msg *dns.Msg, block entity.BlockResponse) *dns.Msg {
+	ttl := block.TTL
+	if ttl == 0 {
+		ttl = defaultBlockTTL
+	}
+	question := msg.Question[0]
+
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	response.RecursionAvailable = true
+
+	switch block.Mode {
+	case entity.BlockRefused:
+		response.Rcode = dns.RcodeRefused
+		return response
+	case entity.BlockNoData:
+	case entity.BlockNullIP:
+		response.Answer = addressAnswer(question, net.IPv4zero, net.IPv6zero, ttl)
+	case entity.BlockCustomIP:
+		response.Answer = addressAnswer(question, net.ParseIP(block.IPv4), net.ParseIP(block.IPv6), ttl)
+	default:
+		response.Rcode = dns.RcodeNameError
+	}
+
+	// negative answers carry a SOA so that clients can cache them for ttl
+	if len(response.Answer) == 0 {
+		response.Ns = append(response.Ns, synthesizeSOA(question.Name, ttl))
+	}
+	return response
+}
+
+// addressAnswer answers A and AAAA questions with the matching address.
+// Other question types get no answer.
+func addressAnswer(question dns.Question, ipv4 net.IP, ipv6 net.IP, ttl uint32) []dns.RR {
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: ttl}
+	switch {
+	case question.Qtype == dns.TypeA && ipv4.To4() != nil:
+		return []dns.RR{&dns.A{Hdr: hdr, A: ipv4.To4()}}
+	case question.Qtype == dns.TypeAAAA && ipv6 != nil && ipv6.To4() == nil:
+		return []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ipv6}}
+	}
+	return nil
+}
+
+// synthesizeSOA builds the SOA record sent along with negative answers. Its
+// minimum field bounds how long clients cache the negative answer.
+func synthesizeSOA(name string, ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      soaNameServer,
+		Mbox:    soaMailbox,
+		Serial:  1,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  ttl,
+	}
+}
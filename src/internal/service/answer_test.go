@@ -0,0 +1,78 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/entity"
+)
+
+func TestBlockedResponse(t *testing.T) {
+	type args struct {
+		qtype uint16
+		block entity.BlockResponse
+	}
+	tests := []struct {
+		name      string
+		args      args
+		wantRcode int
+		wantRR    string
+		wantSOA   bool
+	}{
+		{
+			name:      "nxdomain with soa",
+			args:      args{qtype: dns.TypeA, block: entity.BlockResponse{}},
+			wantRcode: dns.RcodeNameError,
+			wantSOA:   true,
+		},
+		{
+			name:      "nodata",
+			args:      args{qtype: dns.TypeA, block: entity.BlockResponse{Mode: entity.BlockNoData, TTL: 30}},
+			wantRcode: dns.RcodeSuccess,
+			wantSOA:   true,
+		},
+		{
+			name:      "refused",
+			args:      args{qtype: dns.TypeA, block: entity.BlockResponse{Mode: entity.BlockRefused}},
+			wantRcode: dns.RcodeRefused,
+		},
+		{
+			name:      "null ip for AAAA",
+			args:      args{qtype: dns.TypeAAAA, block: entity.BlockResponse{Mode: entity.BlockNullIP, TTL: 10}},
+			wantRcode: dns.RcodeSuccess,
+			wantRR:    "blocked.example.\t10\tIN\tAAAA\t::",
+		},
+		{
+			name:      "custom ip for A",
+			args:      args{qtype: dns.TypeA, block: entity.BlockResponse{Mode: entity.BlockCustomIP, IPv4: "192.0.2.1"}},
+			wantRcode: dns.RcodeSuccess,
+			wantRR:    "blocked.example.\t60\tIN\tA\t192.0.2.1",
+		},
+		{
+			name:      "custom ip without AAAA address",
+			args:      args{qtype: dns.TypeAAAA, block: entity.BlockResponse{Mode: entity.BlockCustomIP, IPv4: "192.0.2.1"}},
+			wantRcode: dns.RcodeSuccess,
+			wantSOA:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetQuestion("blocked.example.", tt.args.qtype)
+
+			got := blockedResponse(msg, tt.args.block)
+			if !got.Response || got.Id != msg.Id {
+				t.Errorf("blockedResponse() is not a reply to the query")
+			}
+			if got.Rcode != tt.wantRcode {
+				t.Errorf("blockedResponse() rcode = %v, want %v", got.Rcode, tt.wantRcode)
+			}
+			if tt.wantRR != "" && (len(got.Answer) != 1 || got.Answer[0].String() != tt.wantRR) {
+				t.Errorf("blockedResponse() answer = %v, want %v", got.Answer, tt.wantRR)
+			}
+			if gotSOA := len(got.Ns) == 1 && got.Ns[0].Header().Rrtype == dns.TypeSOA; gotSOA != tt.wantSOA {
+				t.Errorf("blockedResponse() authority = %v, want soa %v", got.Ns, tt.wantSOA)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blockEventTTL is how long a block is remembered for the block page
+const blockEventTTL = 10 * time.Minute
+
+// BlockEvent describes why a domain was blocked for a client
+type BlockEvent struct {
+	Domain     string
+	Category   string
+	PresetID   string
+	PresetName string
+	// ReopensAt is the start of the next scheduled access window, zero when
+	// the domain stays blocked
+	ReopensAt time.Time
+	// UTCOffset of the preset in minutes, used to display ReopensAt
+	UTCOffset int
+	// SoftBlock is set when the domain may be opened after confirmation
+	SoftBlock bool
+	BlockedAt time.Time
+
+	// token is the last one issued to confirm a soft block
+	token string
+}
+
+// BlockLog remembers recent blocks so that the block page can explain them
+type BlockLog struct {
+	mu        sync.Mutex
+	events    map[string]BlockEvent
+	lastPrune time.Time
+}
+
+func NewBlockLog() *BlockLog {
+	return &BlockLog{
+		events: make(map[string]BlockEvent),
+	}
+}
+
+// Record remembers event for the client and for the domain alone
+func (l *BlockLog) Record(client netip.Addr, event BlockEvent) {
+	event.Domain = strings.ToLower(removeLastPeriod(event.Domain))
+	event.BlockedAt = time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(event.BlockedAt)
+	if client.IsValid() {
+		l.events[blockLogKey(client, event.Domain)] = event
+	}
+	l.events[blockLogKey(netip.Addr{}, event.Domain)] = event
+}
+
+// Lookup returns the block of domain for client. It falls back to the last
+// block of domain by any client.
+func (l *BlockLog) Lookup(client netip.Addr, domain string) (BlockEvent, bool) {
+	domain = strings.ToLower(removeLastPeriod(domain))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for _, key := range []string{blockLogKey(client, domain), blockLogKey(netip.Addr{}, domain)} {
+		if event, ok := l.events[key]; ok && now.Sub(event.BlockedAt) < blockEventTTL {
+			return event, true
+		}
+	}
+	return BlockEvent{}, false
+}
+
+// IssueToken returns a new token for the client to confirm the soft block of
+// domain, replacing the previous one. Only blocks recorded for the client
+// itself can be confirmed.
+func (l *BlockLog) IssueToken(client netip.Addr, domain string) (string, bool) {
+	if !client.IsValid() {
+		return "", false
+	}
+	key := blockLogKey(client, strings.ToLower(removeLastPeriod(domain)))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	event, ok := l.events[key]
+	if !ok || !event.SoftBlock || time.Since(event.BlockedAt) >= blockEventTTL {
+		return "", false
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", false
+	}
+	event.token = hex.EncodeToString(b)
+	l.events[key] = event
+	return event.token, true
+}
+
+// Confirm returns the soft block of domain for client when token is the one
+// last issued for it. The token can only be used once.
+func (l *BlockLog) Confirm(client netip.Addr, domain string, token string) (BlockEvent, bool) {
+	if !client.IsValid() || token == "" {
+		return BlockEvent{}, false
+	}
+	key := blockLogKey(client, strings.ToLower(removeLastPeriod(domain)))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	event, ok := l.events[key]
+	if !ok || !event.SoftBlock || time.Since(event.BlockedAt) >= blockEventTTL ||
+		subtle.ConstantTimeCompare([]byte(event.token), []byte(token)) != 1 {
+		return BlockEvent{}, false
+	}
+	event.token = ""
+	l.events[key] = event
+	return event, true
+}
+
+func (l *BlockLog) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, event := range l.events {
+		if now.Sub(event.BlockedAt) >= blockEventTTL {
+			delete(l.events, key)
+		}
+	}
+}
+
+func blockLogKey(client netip.Addr, domain string) string {
+	if !client.IsValid() {
+		return domain
+	}
+	return client.String() + "|" + domain
+}
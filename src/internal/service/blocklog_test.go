@@ -0,0 +1,35 @@
+package service
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestBlockLog_Confirm(t *testing.T) {
+	client := netip.MustParseAddr("192.0.2.1")
+	other := netip.MustParseAddr("192.0.2.2")
+	blockLog := NewBlockLog()
+	blockLog.Record(client, BlockEvent{Domain: "example.com.", PresetID: "preset", SoftBlock: true})
+
+	if _, ok := blockLog.IssueToken(other, "example.com"); ok {
+		t.Error("BlockLog.IssueToken() issued a token to a client without a block")
+	}
+	token, ok := blockLog.IssueToken(client, "example.com")
+	if !ok {
+		t.Fatal("BlockLog.IssueToken() issued no token to the blocked client")
+	}
+
+	if _, ok := blockLog.Confirm(client, "example.com", "forged"); ok {
+		t.Error("BlockLog.Confirm() accepted a forged token")
+	}
+	if _, ok := blockLog.Confirm(other, "example.com", token); ok {
+		t.Error("BlockLog.Confirm() accepted the token of another client")
+	}
+	event, ok := blockLog.Confirm(client, "Example.com.", token)
+	if !ok || event.PresetID != "preset" {
+		t.Fatalf("BlockLog.Confirm() = %v, %v, want the block of the client", event, ok)
+	}
+	if _, ok := blockLog.Confirm(client, "example.com", token); ok {
+		t.Error("BlockLog.Confirm() accepted a token twice")
+	}
+}
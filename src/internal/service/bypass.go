@@ -0,0 +1,62 @@
+package service
+
+import "github.com/quaintdev/webshield/src/internal/repository"
+
+// bypassCategory is reported for domains blocked by bypass prevention
+const bypassCategory = "Filter Bypass"
+
+// bypassDomains lists hostnames used to escape DNS filtering. Subdomains of
+// every entry are matched as well.
+var bypassDomains = []string{
+	// firefox disables its built-in DoH when the canary domain does not resolve
+	"use-application-dns.net",
+
+	// iCloud Private Relay
+	"mask.icloud.com",
+	"mask-h2.icloud.com",
+
+	// public DoH/DoT resolvers
+	"dns.google",
+	"dns.google.com",
+	"dns64.dns.google",
+	"8888.google",
+	"cloudflare-dns.com",
+	"one.one.one.one",
+	"dns.quad9.net",
+	"dns9.quad9.net",
+	"dns10.quad9.net",
+	"dns11.quad9.net",
+	"doh.opendns.com",
+	"doh.familyshield.opendns.com",
+	"doh.umbrella.com",
+	"dns.nextdns.io",
+	"dns.adguard.com",
+	"dns-family.adguard.com",
+	"dns-unfiltered.adguard.com",
+	"dns.adguard-dns.com",
+	"family.adguard-dns.com",
+	"unfiltered.adguard-dns.com",
+	"doh.cleanbrowsing.org",
+	"doh.mullvad.net",
+	"dns.mullvad.net",
+	"dns.controld.com",
+	"freedns.controld.com",
+	"doh.dns.sb",
+	"dns0.eu",
+	"dns.alidns.com",
+	"doh.pub",
+	"dot.pub",
+	"doh.xfinity.com",
+	"doh.libredns.gr",
+	"doh.applied-privacy.net",
+	"dns.switch.ch",
+	"odvr.nic.cz",
+}
+
+func newBypassDomainStore() *repository.DomainDataStore {
+	store := repository.NewDomainDataSTore()
+	for _, domain := range bypassDomains {
+		store.AddDomain(domain, bypassCategory)
+	}
+	return store
+}
@@ -0,0 +1,337 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultMaxCacheTTL bounds the time answers are cached unless
+	// configured otherwise
+	defaultMaxCacheTTL = 24 * 60 * 60
+	// defaultStaleTTL is how long expired answers are kept for serve-stale
+	// unless configured otherwise
+	defaultStaleTTL = 24 * 60 * 60
+	// staleAnswerTTL is the TTL of stale answers as recommended by RFC 8767
+	staleAnswerTTL = 30
+	// staleAnswerTimeout is how long a query for an expired entry waits for
+	// upstreams before the stale answer is served
+	staleAnswerTimeout = 1800 * time.Millisecond
+	// refreshTimeout bounds background refreshes of cache entries
+	refreshTimeout = 10 * time.Second
+	// prefetchMinHits answers make an entry popular enough for prefetch
+	prefetchMinHits = 2
+	// prefetchWindow divides the lifetime of an entry, entries are
+	// prefetched within the last part
+	prefetchWindow = 10
+)
+
+// CacheConf configures the cache. TTL bounds are in seconds and apply to
+// positive and negative answers alike.
+type CacheConf struct {
+	// MinTTL raises shorter TTLs, 0 keeps them
+	MinTTL uint32
+	// MaxTTL lowers longer TTLs, one day when 0
+	MaxTTL uint32
+	// ServeStale answers with expired entries when upstreams fail or are
+	// slow
+	ServeStale bool
+	// StaleTTL is how long entries are served after they expired, one day
+	// when 0
+	StaleTTL uint32
+	// Prefetch refreshes popular entries shortly before they expire
+	Prefetch bool
+	// Size is the number of entries cached, 10000 when 0
+	Size int
+	// Persist saves the cache periodically and on shutdown and restores it
+	// on startup
+	Persist bool
+}
+
+// staleTTL returns how long expired entries are kept
+func (c *CacheConf) staleTTL() time.Duration {
+	if c.StaleTTL == 0 {
+		return defaultStaleTTL * time.Second
+	}
+	return time.Duration(c.StaleTTL) * time.Second
+}
+
+// clamp bounds ttl by the configured limits
+func (c *CacheConf) clamp(ttl uint32) uint32 {
+	maxTTL := c.MaxTTL
+	if maxTTL == 0 {
+		maxTTL = defaultMaxCacheTTL
+	}
+	return min(max(ttl, c.MinTTL), max(maxTTL, c.MinTTL))
+}
+
+// cacheTTL returns how long response may be cached, 0 when it must not be.
+// Negative answers are cached for the SOA minimum as of RFC 2308 and are not
+// cached without a SOA. Failures and truncated responses are never cached.
+func (c *CacheConf) cacheTTL(response *dns.Msg) uint32 {
+	if response.Truncated || (response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError) {
+		return 0
+	}
+	if response.Rcode == dns.RcodeNameError || len(response.Answer) == 0 {
+		soa := soaOf(response)
+		if soa == nil {
+			return 0
+		}
+		return c.clamp(min(soa.Hdr.Ttl, soa.Minttl))
+	}
+	ttl := response.Answer[0].Header().Ttl
+	for _, rr := range response.Answer[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	return c.clamp(ttl)
+}
+
+// soaOf returns the SOA record of the authority section
+func soaOf(response *dns.Msg) *dns.SOA {
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+// createCacheKey identifies the answer to msg. Names are compared case
+// insensitively, and the DO and CD bits are part of the key as they change
+// which records and how much validation upstreams apply. So is the client
+// subnet, answers may differ between subnets.
+func createCacheKey(msg *dns.Msg) string {
+	if len(msg.Question) == 0 {
+		return ""
+	}
+	question := msg.Question[0]
+	var key strings.Builder
+	key.WriteString(strings.ToLower(question.Name))
+	key.WriteString("|")
+	key.WriteString(strconv.Itoa(int(question.Qtype)))
+	key.WriteString("|")
+	key.WriteString(strconv.Itoa(int(question.Qclass)))
+	if opt := msg.IsEdns0(); opt != nil && opt.Do() {
+		key.WriteString("|do")
+	}
+	if msg.CheckingDisabled {
+		key.WriteString("|cd")
+	}
+	if subnet := subnetOf(msg); subnet != nil {
+		key.WriteString("|ecs=")
+		key.WriteString(subnetKey(subnet, int(subnet.SourceNetmask)))
+	}
+	return key.String()
+}
+
+// CachedResponse is an upstream response kept in the cache. Response is never
+// handed out, clients receive copies made by reply.
+type CachedResponse struct {
+	Response  *dns.Msg
+	CachedAt  time.Time
+	ExpiresAt time.Time
+	// hits counts the answers given from the entry
+	hits atomic.Int64
+	// refreshing is set while the entry is refreshed in the background
+	refreshing atomic.Bool
+}
+
+// newCachedResponse keeps a copy of response for ttl seconds so that later
+// changes by the caller do not reach the cache. TTLs of the copy are bounded
+// by conf, and the SOA of a negative answer carries the negative TTL.
+func newCachedResponse(response *dns.Msg, conf *CacheConf, ttl uint32, now time.Time) *CachedResponse {
+	response = response.Copy()
+	negative := response.Rcode == dns.RcodeNameError || len(response.Answer) == 0
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			header := rr.Header()
+			switch {
+			case header.Rrtype == dns.TypeOPT:
+			case header.Rrtype == dns.TypeSOA && negative:
+				header.Ttl = conf.clamp(min(header.Ttl, rr.(*dns.SOA).Minttl))
+			default:
+				header.Ttl = conf.clamp(header.Ttl)
+			}
+		}
+	}
+	return &CachedResponse{
+		Response:  response,
+		CachedAt:  now,
+		ExpiresAt: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// fresh reports whether the entry has not expired at now
+func (c *CachedResponse) fresh(now time.Time) bool {
+	return now.Before(c.ExpiresAt)
+}
+
+// popular counts an answer from the entry and reports whether the entry is
+// due for prefetch: it was asked for repeatedly and is about to expire
+func (c *CachedResponse) popular(now time.Time) bool {
+	hits := c.hits.Add(1)
+	lifetime := c.ExpiresAt.Sub(c.CachedAt)
+	return hits >= prefetchMinHits && c.ExpiresAt.Sub(now) <= lifetime/prefetchWindow
+}
+
+// reply answers msg with a copy of the cached response. The copy carries the
+// ID and question of msg, and TTLs are reduced by the time spent in the cache.
+func (c *CachedResponse) reply(msg *dns.Msg, now time.Time) *dns.Msg {
+	response := replyTo(msg, c.Response)
+
+	elapsed := uint32(max(now.Sub(c.CachedAt)/time.Second, 0))
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				// the TTL field of OPT carries flags
+				continue
+			}
+			rr.Header().Ttl -= min(rr.Header().Ttl, elapsed)
+		}
+	}
+	return response
+}
+
+// replyTo copies response for the client that sent msg. The copy carries the
+// ID and question of msg.
+func replyTo(msg *dns.Msg, response *dns.Msg) *dns.Msg {
+	response = response.Copy()
+	response.Id = msg.Id
+	response.Question = append([]dns.Question(nil), msg.Question...)
+	return response
+}
+
+// replyStale answers msg with the expired response. Records carry
+// staleAnswerTTL and the answer is marked stale as of RFC 8914.
+func (c *CachedResponse) replyStale(msg *dns.Msg) *dns.Msg {
+	response := c.reply(msg, c.CachedAt)
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = staleAnswerTTL
+			}
+		}
+	}
+	if clientOpt := msg.IsEdns0(); clientOpt != nil {
+		opt := response.IsEdns0()
+		if opt == nil {
+			response.SetEdns0(clientOpt.UDPSize(), clientOpt.Do())
+			opt = response.IsEdns0()
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+	}
+	return response
+}
+
+// fetch queries the servers of selector for msg and caches the response
+// under key. Answers are validated before they are cached.
+func (dnsService *DNSService) fetch(ctx context.Context, key string, msg *dns.Msg, selector *DNSServerSelector) (*dns.Msg, error) {
+	query := msg
+	validating := dnsService.validating(msg, selector)
+	if validating {
+		// the upstream has to return bogus answers for them to be validated
+		query = msg.Copy()
+		query.CheckingDisabled = true
+	}
+	response, err := dnsService.queryServers(ctx, query, selector)
+	if err != nil {
+		return nil, err
+	}
+	if validating {
+		response = dnsService.validate(ctx, msg, response)
+	} else if dnsService.validator != nil {
+		// answers the upstream did not validate either are not authenticated
+		response.AuthenticatedData = false
+	}
+
+	ttl := dnsService.cacheConf.cacheTTL(response)
+	if ttl == 0 {
+		slog.Debug("not caching response", "key", key, "rcode", response.Rcode)
+		return response, nil
+	}
+	// answers hold for the subnets sharing the first scope bits with the
+	// subnet of the query, answers without subnet for every subnet
+	if subnet := subnetOf(msg); subnet != nil {
+		scope := 0
+		if responseSubnet := subnetOf(response); responseSubnet != nil {
+			scope = min(int(responseSubnet.SourceScope), int(subnet.SourceNetmask))
+		}
+		key = scopedKey(key, subnet, scope)
+	}
+	// expired entries are kept around to be served when upstreams fail
+	keep := time.Duration(ttl) * time.Second
+	if dnsService.cacheConf.ServeStale {
+		keep += dnsService.cacheConf.staleTTL()
+	}
+	slog.Debug("adding to cache", "key", key, "ttl", ttl)
+	dnsService.cache.Set(key, newCachedResponse(response, dnsService.cacheConf, ttl, time.Now()), keep)
+	return response, nil
+}
+
+// refresh fetches msg again in the background unless the entry is being
+// refreshed already. The returned channel yields the new response, it is
+// closed without one when the refresh failed or did not start.
+func (dnsService *DNSService) refresh(key string, cached *CachedResponse, msg *dns.Msg, selector *DNSServerSelector) <-chan *dns.Msg {
+	done := make(chan *dns.Msg, 1)
+	if !cached.refreshing.CompareAndSwap(false, true) {
+		close(done)
+		return done
+	}
+	// the query of the client must not be shared with the background query
+	msg = msg.Copy()
+	go func() {
+		defer close(done)
+		defer cached.refreshing.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+		response, err := dnsService.fetch(ctx, key, msg, selector)
+		if err != nil {
+			slog.Debug("failed to refresh cache entry", "key", key, "error", err)
+			return
+		}
+		if response.Rcode == dns.RcodeServerFailure {
+			slog.Debug("failed to refresh cache entry", "key", key, "rcode", response.Rcode)
+			return
+		}
+		done <- response
+	}()
+	return done
+}
+
+// prefetch refreshes a popular entry before it expires
+func (dnsService *DNSService) prefetch(key string, cached *CachedResponse, msg *dns.Msg, selector *DNSServerSelector) {
+	slog.Debug("prefetching cache entry", "key", key)
+	dnsService.cache.prefetches.Add(1)
+	dnsService.refresh(key, cached, msg, selector)
+}
+
+// serveStale answers msg for an expired entry. The entry is refreshed and the
+// new answer is returned when it arrives within staleAnswerTimeout; otherwise,
+// or when upstreams fail, the expired answer is served as of RFC 8767.
+func (dnsService *DNSService) serveStale(ctx context.Context, key string, cached *CachedResponse, msg *dns.Msg, selector *DNSServerSelector) (*dns.Msg, error) {
+	if !dnsService.cacheConf.ServeStale {
+		return dnsService.fetchShared(ctx, key, msg, selector)
+	}
+
+	done := dnsService.refresh(key, cached, msg, selector)
+	timer := time.NewTimer(staleAnswerTimeout)
+	defer timer.Stop()
+	select {
+	case response, ok := <-done:
+		if ok {
+			return replyTo(msg, response), nil
+		}
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	slog.Info("serving stale answer", "key", key, "expiredAt", cached.ExpiresAt)
+	dnsService.cache.staleAnswers.Add(1)
+	return cached.replyStale(msg), nil
+}
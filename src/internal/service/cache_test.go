@@ -0,0 +1,232 @@
+package service
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/entity"
+	"github.com/quaintdev/webshield/src/internal/upstream"
+)
+
+func TestCreateCacheKey(t *testing.T) {
+	query := func(name string, qclass uint16, do, cd bool) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.Question[0].Qclass = qclass
+		msg.CheckingDisabled = cd
+		if do {
+			msg.SetEdns0(dns.DefaultMsgSize, true)
+		}
+		return msg
+	}
+	base := createCacheKey(query("example.com.", dns.ClassINET, false, false))
+	if got := createCacheKey(query("ExAmPlE.com.", dns.ClassINET, false, false)); got != base {
+		t.Errorf("createCacheKey() = %q, want %q regardless of case", got, base)
+	}
+	distinct := map[string]*dns.Msg{
+		"class": query("example.com.", dns.ClassCHAOS, false, false),
+		"DO":    query("example.com.", dns.ClassINET, true, false),
+		"CD":    query("example.com.", dns.ClassINET, false, true),
+	}
+	for name, msg := range distinct {
+		if got := createCacheKey(msg); got == base {
+			t.Errorf("createCacheKey() ignores %s", name)
+		}
+	}
+}
+
+func TestCachedResponse_reply(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	response.Answer = append(response.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(192, 0, 2, 1),
+	})
+	now := time.Now()
+	cached := newCachedResponse(response, &CacheConf{}, 300, now.Add(-100*time.Second))
+	response.Answer[0].Header().Ttl = 1
+
+	query := new(dns.Msg)
+	query.SetQuestion("EXAMPLE.com.", dns.TypeA)
+	reply := cached.reply(query, now)
+	if reply.Id != query.Id {
+		t.Errorf("CachedResponse.reply() id = %d, want %d", reply.Id, query.Id)
+	}
+	if reply.Question[0].Name != "EXAMPLE.com." {
+		t.Errorf("CachedResponse.reply() question = %s, want case of the query", reply.Question[0].Name)
+	}
+	if ttl := reply.Answer[0].Header().Ttl; ttl != 200 {
+		t.Errorf("CachedResponse.reply() ttl = %d, want 200", ttl)
+	}
+
+	reply.Answer[0].Header().Ttl = 0
+	if ttl := cached.reply(query, now).Answer[0].Header().Ttl; ttl != 200 {
+		t.Errorf("CachedResponse.reply() ttl = %d after changing an earlier reply, want 200", ttl)
+	}
+	if ttl := cached.reply(query, now.Add(time.Hour)).Answer[0].Header().Ttl; ttl != 0 {
+		t.Errorf("CachedResponse.reply() ttl = %d past expiry, want 0", ttl)
+	}
+}
+
+func TestCacheConf_cacheTTL(t *testing.T) {
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: 600,
+	}
+	a := func(ttl uint32) dns.RR {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IPv4(192, 0, 2, 1),
+		}
+	}
+	response := func(rcode int, answer []dns.RR, ns []dns.RR) *dns.Msg {
+		return &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: rcode}, Answer: answer, Ns: ns}
+	}
+
+	tests := []struct {
+		name     string
+		conf     CacheConf
+		response *dns.Msg
+		want     uint32
+	}{
+		{name: "least ttl", response: response(dns.RcodeSuccess, []dns.RR{a(300), a(60)}, nil), want: 60},
+		{name: "nxdomain", response: response(dns.RcodeNameError, nil, []dns.RR{soa}), want: 600},
+		{name: "nodata", response: response(dns.RcodeSuccess, nil, []dns.RR{soa}), want: 600},
+		{name: "negative without soa", response: response(dns.RcodeNameError, nil, nil), want: 0},
+		{name: "servfail", response: response(dns.RcodeServerFailure, nil, []dns.RR{soa}), want: 0},
+		{name: "ttl 0", response: response(dns.RcodeSuccess, []dns.RR{a(0)}, nil), want: 0},
+		{name: "min ttl", conf: CacheConf{MinTTL: 30}, response: response(dns.RcodeSuccess, []dns.RR{a(0)}, nil), want: 30},
+		{name: "max ttl", conf: CacheConf{MaxTTL: 120}, response: response(dns.RcodeSuccess, []dns.RR{a(300)}, nil), want: 120},
+		{name: "max ttl negative", conf: CacheConf{MaxTTL: 120}, response: response(dns.RcodeNameError, nil, []dns.RR{soa}), want: 120},
+		{name: "default max ttl", response: response(dns.RcodeSuccess, []dns.RR{a(1 << 30)}, nil), want: defaultMaxCacheTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.conf.cacheTTL(tt.response); got != tt.want {
+				t.Errorf("CacheConf.cacheTTL() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// flakyHandler answers A queries with 192.0.2.1, or with SERVFAIL while
+// down is set. queries counts the queries received.
+func flakyHandler(down *atomic.Bool, queries *atomic.Int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if down.Load() {
+			m.Rcode = dns.RcodeServerFailure
+		} else {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(192, 0, 2, 1),
+			})
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func newCachingDNSService(server string, conf *CacheConf) *DNSService {
+	return &DNSService{
+		upstreamServerSelector: NewDNSServerSelector([]string{server}),
+		forwarding:             newForwardingRouter(nil),
+		upstreams:              upstream.NewPool(upstream.Options{}),
+		cache:                  newResponseCache(0),
+		cacheConf:              conf,
+	}
+}
+
+// expire moves the cache entry of msg towards its expiry, so that only left
+// of its lifetime remains
+func expire(t *testing.T, dnsService *DNSService, msg *dns.Msg, left time.Duration) {
+	t.Helper()
+	cached, ok := dnsService.cache.Get(createCacheKey(msg))
+	if !ok {
+		t.Fatal("response not cached")
+	}
+	shift := cached.ExpiresAt.Sub(time.Now()) - left
+	cached.CachedAt = cached.CachedAt.Add(-shift)
+	cached.ExpiresAt = cached.ExpiresAt.Add(-shift)
+}
+
+func TestDNSService_serveStale(t *testing.T) {
+	var down atomic.Bool
+	var queries atomic.Int32
+	dnsService := newCachingDNSService(startStandIn(t, flakyHandler(&down, &queries)), &CacheConf{ServeStale: true})
+	defer dnsService.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	config := &entity.Settings{}
+	if _, err := dnsService.resolve(context.Background(), config, msg); err != nil {
+		t.Fatal(err)
+	}
+	expire(t, dnsService, msg, -time.Minute)
+
+	down.Store(true)
+	response, err := dnsService.resolve(context.Background(), config, msg)
+	if err != nil {
+		t.Fatalf("DNSService.resolve() error = %v, want stale answer", err)
+	}
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 || response.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Fatalf("DNSService.resolve() = %v, want stale answer with ttl %d", response, staleAnswerTTL)
+	}
+	if ede, ok := response.IsEdns0().Option[len(response.IsEdns0().Option)-1].(*dns.EDNS0_EDE); !ok || ede.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Errorf("DNSService.resolve() options = %v, want stale answer error", response.IsEdns0().Option)
+	}
+
+	down.Store(false)
+	response, err = dnsService.resolve(context.Background(), config, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := response.Answer[0].Header().Ttl; ttl != 300 {
+		t.Errorf("DNSService.resolve() ttl = %d, want refreshed answer", ttl)
+	}
+}
+
+func TestDNSService_prefetch(t *testing.T) {
+	var down atomic.Bool
+	var queries atomic.Int32
+	dnsService := newCachingDNSService(startStandIn(t, flakyHandler(&down, &queries)), &CacheConf{Prefetch: true})
+	defer dnsService.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	config := &entity.Settings{}
+	if _, err := dnsService.resolve(context.Background(), config, msg); err != nil {
+		t.Fatal(err)
+	}
+	expire(t, dnsService, msg, 10*time.Second)
+
+	for range prefetchMinHits {
+		if _, err := dnsService.resolve(context.Background(), config, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for queries.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := queries.Load(); got != 2 {
+		t.Fatalf("upstream received %d queries, want entry prefetched once", got)
+	}
+	for time.Now().Before(deadline) {
+		if cached, _ := dnsService.cache.Get(createCacheKey(msg)); cached.ExpiresAt.Sub(time.Now()) > time.Minute {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("prefetched response not cached")
+}
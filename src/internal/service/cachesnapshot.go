@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/quaintdev/webshield/src/internal/repository"
+)
+
+// cacheSnapshotInterval is the period of cache snapshots
+const cacheSnapshotInterval = 5 * time.Minute
+
+// LoadCache warms the cache with the saved entries that are still valid
+func (dnsService *DNSService) LoadCache(ctx context.Context, cacheRepo repository.CacheRepository) error {
+	entries, err := cacheRepo.GetCacheEntries(ctx)
+	if err != nil {
+		return err
+	}
+	restored := dnsService.cache.Restore(entries, time.Now())
+	slog.Info("restored cache", "entries", restored, "saved", len(entries))
+	return nil
+}
+
+// SaveCache replaces the saved entries with the current cache
+func (dnsService *DNSService) SaveCache(ctx context.Context, cacheRepo repository.CacheRepository) error {
+	entries := dnsService.cache.Snapshot(time.Now())
+	if err := cacheRepo.ReplaceCacheEntries(ctx, entries); err != nil {
+		return err
+	}
+	slog.Debug("saved cache", "entries", len(entries))
+	return nil
+}
+
+// StartCacheSnapshots saves the cache periodically until ctx is done
+func (dnsService *DNSService) StartCacheSnapshots(ctx context.Context, cacheRepo repository.CacheRepository) {
+	go func() {
+		ticker := time.NewTicker(cacheSnapshotInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := dnsService.SaveCache(ctx, cacheRepo); err != nil {
+					slog.Error("error while saving cache", "error", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/quaintdev/webshield/src/internal/entity"
+)
+
+type memoryCacheRepo struct {
+	entries []entity.CacheEntry
+}
+
+func (m *memoryCacheRepo) GetCacheEntries(ctx context.Context) ([]entity.CacheEntry, error) {
+	return m.entries, nil
+}
+
+func (m *memoryCacheRepo) ReplaceCacheEntries(ctx context.Context, entries []entity.CacheEntry) error {
+	m.entries = entries
+	return nil
+}
+
+func TestDNSService_SaveCache(t *testing.T) {
+	saved := &DNSService{cache: newResponseCache(0)}
+	saved.cache.Set("old", cachedAnswer("old.example."), time.Minute)
+	saved.cache.Set("new", cachedAnswer("new.example."), time.Minute)
+	saved.cache.Set("gone", cachedAnswer("gone.example."), -time.Second)
+	repo := &memoryCacheRepo{}
+	if err := saved.SaveCache(context.Background(), repo); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.entries) != 2 {
+		t.Fatalf("DNSService.SaveCache() saved %d entries, want 2", len(repo.entries))
+	}
+	repo.entries = append(repo.entries, entity.CacheEntry{Key: "expired", KeepUntil: time.Now().Add(-time.Second)})
+
+	restored := &DNSService{cache: newResponseCache(1)}
+	if err := restored.LoadCache(context.Background(), repo); err != nil {
+		t.Fatal(err)
+	}
+	// entries are restored in order of use, so the capacity keeps the newest
+	cached, ok := restored.cache.Get("new")
+	if !ok {
+		t.Fatal("DNSService.LoadCache() did not restore entry")
+	}
+	original, _ := saved.cache.Get("new")
+	if !cached.CachedAt.Equal(original.CachedAt) || !cached.ExpiresAt.Equal(original.ExpiresAt) {
+		t.Errorf("DNSService.LoadCache() times = %v %v, want %v %v", cached.CachedAt, cached.ExpiresAt, original.CachedAt, original.ExpiresAt)
+	}
+	if cached.Response.Question[0].Name != "new.example." {
+		t.Errorf("DNSService.LoadCache() response = %v", cached.Response)
+	}
+	if _, ok := restored.cache.Get("old"); ok {
+		t.Error("DNSService.LoadCache() kept least recently used entry over capacity")
+	}
+}
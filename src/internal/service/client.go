@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+)
+
+type clientAddrKey struct{}
+
+// WithClientAddr attaches the address of the client sending a query to ctx
+func WithClientAddr(ctx context.Context, addr netip.Addr) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// ClientAddrFromContext returns the client address attached to ctx
+func ClientAddrFromContext(ctx context.Context) (netip.Addr, bool) {
+	addr, ok := ctx.Value(clientAddrKey{}).(netip.Addr)
+	return addr, ok && addr.IsValid()
+}
+
+// ParseClientAddr parses remote addresses in either "ip:port" or "ip" form
+func ParseClientAddr(remoteAddr string) netip.Addr {
+	if addrPort, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		return addrPort.Addr().Unmap()
+	}
+	if addr, err := netip.ParseAddr(remoteAddr); err == nil {
+		return addr.Unmap()
+	}
+	return netip.Addr{}
+}
+
+// ParseTrustedProxies parses the addresses and CIDR ranges of reverse proxies
+// trusted to tell the address of clients
+func ParseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/quaintdev/webshield/src/internal/entity"
 	"github.com/quaintdev/webshield/src/internal/repository"
 )
 
@@ -15,16 +16,60 @@ type CertConf struct {
 	KeyPath  string
 }
 
+// BlockPageConf configures the server answering HTTP requests to domains
+// blocked with a custom ip
+type BlockPageConf struct {
+	HTTPAddr  string
+	HTTPSAddr string
+	// CACertPath and CAKeyPath point to an optional CA used to mint
+	// certificates for blocked domains on the fly
+	CACertPath string
+	CAKeyPath  string
+	// IPv4 and IPv6 of the block page server are answered for domains that
+	// show an interstitial
+	IPv4 string
+	IPv6 string
+}
+
+// RecursionConf configures the "recursive" entry of DNSServers, which
+// resolves queries from the root servers instead of forwarding them
+type RecursionConf struct {
+	// RootHints replace the addresses of the root servers
+	RootHints []string
+	// DisableQNAMEMinimization sends the full name of queries to every
+	// server instead of one label more than they are authoritative for
+	DisableQNAMEMinimization bool
+}
+
 type Category struct {
 	Name     string `json:"name"`
 	FilePath string `json:"file"`
 }
 
 type Config struct {
-	CertConfig        CertConf
-	Categories        []Category
-	DNSServers        []string
+	CertConfig CertConf
+	Categories []Category
+	DNSServers []string
+	// BootstrapServers resolve the hostnames of DNSServers given as
+	// tls:// or https:// urls
+	BootstrapServers []string
+	Recursion        RecursionConf
+	Upstream         UpstreamConf
+	// UpstreamGroups are named sets of servers presets can use instead of
+	// DNSServers
+	UpstreamGroups    map[string][]string
+	ForwardingRules   []entity.ForwardingRule
 	WebsiteExceptions []Category
+	BlockPage         BlockPageConf
+	Cache             CacheConf
+	ECS               ECSConf
+	DNSSEC            DNSSECConf
+	// AdminToken authorizes requests to the admin API sent with an
+	// "Authorization: Bearer" header. The admin API is disabled when empty.
+	AdminToken string
+	// TrustedProxies are addresses or CIDR ranges of the reverse proxies in
+	// front of the DoH endpoint. Only they may set X-Forwarded-For.
+	TrustedProxies []string
 }
 
 type ApplicationConfigService struct {
@@ -81,10 +126,54 @@ func (c *ApplicationConfigService) GetCertConf() *CertConf {
 	return &c.config.CertConfig
 }
 
+func (c *ApplicationConfigService) GetBlockPageConf() *BlockPageConf {
+	return &c.config.BlockPage
+}
+
 func (c *ApplicationConfigService) GetDNSServers() []string {
 	return c.config.DNSServers
 }
 
+func (c *ApplicationConfigService) GetUpstreamConf() *UpstreamConf {
+	return &c.config.Upstream
+}
+
+func (c *ApplicationConfigService) GetECSConf() *ECSConf {
+	return &c.config.ECS
+}
+
+func (c *ApplicationConfigService) GetAdminToken() string {
+	return c.config.AdminToken
+}
+
+func (c *ApplicationConfigService) GetTrustedProxies() []string {
+	return c.config.TrustedProxies
+}
+
+func (c *ApplicationConfigService) GetRecursionConf() *RecursionConf {
+	return &c.config.Recursion
+}
+
+func (c *ApplicationConfigService) GetDNSSECConf() *DNSSECConf {
+	return &c.config.DNSSEC
+}
+
+func (c *ApplicationConfigService) GetCacheConf() *CacheConf {
+	return &c.config.Cache
+}
+
+func (c *ApplicationConfigService) GetUpstreamGroups() map[string][]string {
+	return c.config.UpstreamGroups
+}
+
+func (c *ApplicationConfigService) GetBootstrapServers() []string {
+	return c.config.BootstrapServers
+}
+
+func (c *ApplicationConfigService) GetForwardingRules() []entity.ForwardingRule {
+	return c.config.ForwardingRules
+}
+
 func (c *ApplicationConfigService) GetCategories() []Category {
 	return c.config.Categories
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"log/slog"
 
 	"github.com/quaintdev/webshield/src/internal/apperrors"
@@ -14,14 +15,16 @@ import (
 
 type DataMgmtService struct {
 	settingsRepo  repository.SettingsRepository
+	rewriteStore  *RewriteStore
 	configService *ApplicationConfigService
 }
 
-func NewDataMgmtService(settingsRepo repository.SettingsRepository,
+func NewDataMgmtService(settingsRepo repository.SettingsRepository, rewriteStore *RewriteStore,
 	configService *ApplicationConfigService) *DataMgmtService {
 	return &DataMgmtService{
 
 		settingsRepo:  settingsRepo,
+		rewriteStore:  rewriteStore,
 		configService: configService,
 	}
 }
@@ -76,6 +79,16 @@ func (s *DataMgmtService) AddConfig(ctx context.Context, req *dto.AddPresetReque
 
 func (s *DataMgmtService) UpdateConfig(ctx context.Context, req *dto.UpdatePresetRequest) (*dto.PresetResponse, error) {
 	slog.Debug("updating config", "configId", req.PresetID)
+	if _, ok := s.configService.GetUpstreamGroups()[req.UpstreamGroup]; req.UpstreamGroup != "" && !ok {
+		return nil, fmt.Errorf("%w: unknown upstream group %q", apperrors.ErrInvalidInput, req.UpstreamGroup)
+	}
+	for _, rule := range req.ForwardingRules {
+		for _, server := range rule.Servers {
+			if err := checkForwardingServer(server, true); err != nil {
+				return nil, err
+			}
+		}
+	}
 
 	config := dto.MakeConfig(req)
 	err := s.settingsRepo.UpdateConfig(ctx, config)
@@ -95,6 +108,12 @@ func (s *DataMgmtService) DeleteConfig(ctx context.Context, configId string) err
 		return err
 	}
 
+	err = s.rewriteStore.DeleteRewrites(ctx, configId)
+	if err != nil {
+		slog.Error("failed to delete rewrites", "err", err)
+		return err
+	}
+
 	return nil
 }
 
@@ -127,6 +146,39 @@ func (s *DataMgmtService) GetAllConfigs(ctx context.Context) ([]*entity.Settings
 	return configs, nil
 }
 
+func (s *DataMgmtService) GetRewrites(ctx context.Context, configId string) ([]dto.Rewrite, error) {
+	_, err := s.settingsRepo.GetConfig(ctx, configId)
+	if err != nil {
+		slog.Error("failed to get config", "error", err)
+		return nil, apperrors.ErrNotFound
+	}
+	rewrites, err := s.rewriteStore.GetRewrites(ctx, configId)
+	if err != nil {
+		slog.Error("failed to get rewrites", "error", err)
+		return nil, err
+	}
+	return dto.MakeRewritesResponse(rewrites), nil
+}
+
+func (s *DataMgmtService) UpdateRewrites(ctx context.Context, configId string, req []dto.Rewrite) ([]dto.Rewrite, error) {
+	slog.Debug("updating rewrites", "configId", configId)
+	_, err := s.settingsRepo.GetConfig(ctx, configId)
+	if err != nil {
+		slog.Error("failed to get config", "error", err)
+		return nil, apperrors.ErrNotFound
+	}
+	rewrites, err := dto.MakeRewrites(req)
+	if err != nil {
+		return nil, err
+	}
+	err = s.rewriteStore.UpdateRewrites(ctx, configId, rewrites)
+	if err != nil {
+		slog.Error("failed to update rewrites", "err", err)
+		return nil, err
+	}
+	return dto.MakeRewritesResponse(rewrites), nil
+}
+
 func generateConfigId() string {
 	const (
 		// Use characters that are safe for DNS labels
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quaintdev/webshield/src/internal/entity"
+)
+
+const (
+	// defaultDelaySeconds applies when a preset has no delay configured
+	defaultDelaySeconds = 10
+	// maxDelay bounds the delay so that clients do not give up on the query
+	maxDelay = 30 * time.Second
+	// visitWindow groups the queries of a single visit
+	visitWindow = time.Minute
+	// maxDelayedQueries bounds the number of queries waiting at once
+	maxDelayedQueries = 1024
+)
+
+type visit struct {
+	day   string
+	count int
+	last  time.Time
+}
+
+// visitCounter counts daily visits of delayed domains per preset
+type visitCounter struct {
+	mu        sync.Mutex
+	visits    map[string]visit
+	lastPrune time.Time
+}
+
+func newVisitCounter() *visitCounter {
+	return &visitCounter{
+		visits: make(map[string]visit),
+	}
+}
+
+// record counts a query for domain and returns the number of visits of the
+// day including this one. Queries within visitWindow of the previous one
+// belong to the same visit.
+func (c *visitCounter) record(config *entity.Settings, domain string, now time.Time) int {
+	key, day := visitKey(config, domain, now)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prune(now)
+
+	v := c.visits[key].after(day, now)
+	c.visits[key] = v
+	return v.count
+}
+
+// peek returns the number of visits of the day a query for domain would
+// count without recording it
+func (c *visitCounter) peek(config *entity.Settings, domain string, now time.Time) int {
+	key, day := visitKey(config, domain, now)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.visits[key].after(day, now).count
+}
+
+func visitKey(config *entity.Settings, domain string, now time.Time) (string, string) {
+	domain = strings.TrimPrefix(strings.ToLower(removeLastPeriod(domain)), "www.")
+	day := now.Add(-time.Duration(config.UTCOffset) * time.Minute).Format(time.DateOnly)
+	return config.ID + "|" + domain, day
+}
+
+// after returns v after a query at now. Queries within visitWindow of the
+// previous one, such as the AAAA and HTTPS queries following an A query,
+// belong to the same visit.
+func (v visit) after(day string, now time.Time) visit {
+	if v.day != day {
+		v = visit{day: day}
+	}
+	if v.count == 0 || now.Sub(v.last) > visitWindow {
+		v.count++
+	}
+	v.last = now
+	return v
+}
+
+func (c *visitCounter) prune(now time.Time) {
+	if now.Sub(c.lastPrune) < time.Hour {
+		return
+	}
+	c.lastPrune = now
+	for key, v := range c.visits {
+		if now.Sub(v.last) > 24*time.Hour {
+			delete(c.visits, key)
+		}
+	}
+}
+
+// delayFor computes the delay of the given visit as per the preset
+func delayFor(config *entity.Settings, visits int) time.Duration {
+	seconds := config.DelaySeconds
+	if seconds <= 0 {
+		seconds = defaultDelaySeconds
+	}
+	seconds += config.DelayIncrementSeconds * (visits - 1)
+	return min(time.Duration(seconds)*time.Second, maxDelay)
+}
@@ -2,187 +2,679 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
-	"math"
-	"strconv"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/ReneKroon/ttlcache"
 	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/apperrors"
+	"github.com/quaintdev/webshield/src/internal/dnssec"
+	"github.com/quaintdev/webshield/src/internal/entity"
+	"github.com/quaintdev/webshield/src/internal/upstream"
 )
 
-func createCacheKey(msg *dns.Msg) string {
-	if len(msg.Question) > 0 {
-		return msg.Question[0].Name + "|" + strconv.Itoa(int(msg.Question[0].Qtype))
-	}
-	return ""
-}
-
-type CachedResponse struct {
-	Response *dns.Msg
-	CachedAt time.Time
-}
-
 type DNSService struct {
 	upstreamServerSelector *DNSServerSelector
 	filteringService       *FilteringService
+	rewriteStore           *RewriteStore
+	forwarding             *forwardingRouter
+	upstreamGroups         map[string]*DNSServerSelector
+	upstreams              *upstream.Pool
 	verbose                bool
-	cache                  *ttlcache.Cache
+	cache                  *responseCache
+	cacheConf              *CacheConf
+	inflight               inflightGroup
+	ecs                    *ecsPolicy
+	validator              *dnssec.Validator
+	blockLog               *BlockLog
+	interstitialResponse   entity.BlockResponse
+	delaySlots             chan struct{}
 }
 
 func NewDNSService(serverSelector *DNSServerSelector, filteringService *FilteringService,
-	configService *ApplicationConfigService) *DNSService {
+	rewriteStore *RewriteStore, configService *ApplicationConfigService) *DNSService {
+	blockPageConf := configService.GetBlockPageConf()
+	recursion := configService.GetRecursionConf()
+	upstreams := upstream.NewPool(upstream.Options{
+		Bootstrap:                configService.GetBootstrapServers(),
+		RootHints:                recursion.RootHints,
+		DisableQNAMEMinimization: recursion.DisableQNAMEMinimization,
+	})
+	ecs, err := newECSPolicy(configService.GetECSConf())
+	if err != nil {
+		slog.Error("invalid client subnet configuration, stripping client subnets", "error", err)
+		ecs = &ecsPolicy{mode: ECSStrip}
+	}
+	validator, err := newValidator(configService.GetDNSSECConf())
+	if err != nil {
+		slog.Error("invalid DNSSEC trust anchors, using the root keys", "error", err)
+		validator = dnssec.NewValidator(dnssec.RootAnchors())
+	}
 	return &DNSService{
 		upstreamServerSelector: serverSelector,
 		filteringService:       filteringService,
-		cache:                  ttlcache.NewCache(),
+		rewriteStore:           rewriteStore,
+		forwarding:             newForwardingRouter(configService.GetForwardingRules()),
+		upstreamGroups:         newUpstreamGroups(configService.GetUpstreamGroups(), configService.GetUpstreamConf()),
+		upstreams:              upstreams,
+		cache:                  newResponseCache(configService.GetCacheConf().Size),
+		cacheConf:              configService.GetCacheConf(),
+		ecs:                    ecs,
+		validator:              validator,
+		blockLog:               NewBlockLog(),
+		delaySlots:             make(chan struct{}, maxDelayedQueries),
+		interstitialResponse: entity.BlockResponse{
+			Mode: entity.BlockCustomIP,
+			IPv4: blockPageConf.IPv4,
+			IPv6: blockPageConf.IPv6,
+			TTL:  InterstitialTTL,
+		},
 	}
 }
 
 func (dnsService *DNSService) ProcessQuery(ctx context.Context, msg *dns.Msg, configId string) (*dns.Msg, error) {
 	startTime := time.Now()
 	domain := msg.Question[0].Name
-	blocked, err := dnsService.filteringService.IsDomainBlocked(ctx, configId, domain)
+	config, err := dnsService.filteringService.GetSettings(ctx, configId)
 	if err != nil {
-		msg.Rcode = dns.RcodeNameError //send NXDOMAIN
+		response := blockedResponse(msg, entity.BlockResponse{Mode: entity.BlockNXDomain})
+		elapsedTime := time.Since(startTime)
+		slog.Error("Error during processig query", "rcode", response.Rcode, "elapsedTime", elapsedTime)
+		return response, nil
+	}
+
+	// query types are refused for local records as well
+	policy, hasPolicy := config.QTypePolicies[msg.Question[0].Qtype]
+	hasPolicy = hasPolicy && config.Enabled
+	if hasPolicy && policy.MaxSize == 0 {
+		response := qtypePolicyResponse(msg, policy)
+		elapsedTime := time.Since(startTime)
+		slog.Debug("Replying back as per query type policy", "domain", domain, "action", policy.Action, "elapsedTime", elapsedTime)
+		return response, nil
+	}
+
+	if records := dnsService.rewriteStore.Lookup(ctx, configId, domain); records != nil {
+		response, err := dnsService.localAnswer(ctx, config, msg, records)
+		if err != nil {
+			return nil, err
+		}
+		elapsedTime := time.Since(startTime)
+		slog.Debug("Replying back with local record", "domain", domain, "rcode", response.Rcode, "elapsedTime", elapsedTime)
+		return response, nil
+	}
+
+	decision := dnsService.filteringService.Evaluate(config, domain)
+	if decision.Action == ActionBlock {
+		response := dnsService.block(ctx, config, msg, decision)
+		elapsedTime := time.Since(startTime)
+		slog.Debug("Replying back", "domain", domain, "rcode", response.Rcode, "elapsedTime", elapsedTime)
+		return response, nil
+	}
+
+	if decision.Action == ActionInterstitial {
+		response := dnsService.interstitial(ctx, config, msg, decision)
 		elapsedTime := time.Since(startTime)
-		slog.Error("Error during processig query", "rcode", msg.Rcode, "elapsedTime", elapsedTime)
-		return msg, nil
-	}
-	if blocked {
-		//rr := new(dns.A)
-		//rr.Hdr = dns.RR_Header{Name: domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0}
-		//rr.A = net.ParseIP("0.0.0.0")
-		//msg.Answer = append(msg.Answer, rr)
-		msg.Rcode = dns.RcodeNameError //send NXDOMAIN
+		slog.Debug("Replying back with interstitial", "domain", domain, "elapsedTime", elapsedTime)
+		return response, nil
+	}
+
+	if decision.Action == ActionDelay {
+		dnsService.filteringService.RecordVisit(config, domain)
+		if err := dnsService.delay(ctx, decision.Delay); err != nil {
+			return nil, err
+		}
+	}
+
+	if decision.Action == ActionRewrite {
+		response, err := dnsService.rewrite(ctx, config, msg, decision.Target)
+		if err != nil {
+			return nil, err
+		}
+		response, _ = dnsService.inspect(ctx, config, msg, domain, response)
+		elapsedTime := time.Since(startTime)
+		slog.Debug("Replying back with rewrite", "domain", domain, "target", decision.Target, "elapsedTime", elapsedTime)
+		return response, nil
+	}
+
+	response, err := dnsService.resolve(ctx, config, msg)
+	if err != nil {
+		return nil, err
+	}
+	if hasPolicy && response.Len() > policy.MaxSize {
+		response := qtypePolicyResponse(msg, policy)
 		elapsedTime := time.Since(startTime)
-		slog.Debug("Replying back", "domain", domain, "rcode", msg.Rcode, "elapsedTime", elapsedTime)
-		return msg, nil
+		slog.Debug("Replying back as per query type policy", "domain", domain, "action", policy.Action,
+			"maxSize", policy.MaxSize, "elapsedTime", elapsedTime)
+		return response, nil
 	}
+	response, _ = dnsService.inspect(ctx, config, msg, domain, response)
+
+	elapsedTime := time.Since(startTime)
+	slog.Debug("Replying back", "domain", domain, "rcode", response.Rcode, "elapsedTime", elapsedTime)
+	return response, nil
+}
+
+// inspect applies the checks on upstream answers to response, which answers
+// msg with records resolved for domain. When the answer is not allowed, the
+// block reply to msg is returned instead along with true.
+func (dnsService *DNSService) inspect(ctx context.Context, config *entity.Settings, msg *dns.Msg, domain string, response *dns.Msg) (*dns.Msg, bool) {
+	if !config.Enabled {
+		return response, false
+	}
+	if config.BlockBypass {
+		response = stripECH(response)
+	}
+	if config.InspectCNAME {
+		if cname, decision := dnsService.inspectCNAMEs(config, response); decision.Action == ActionBlock {
+			slog.Info("blocked cloaked domain", "domain", msg.Question[0].Name, "cname", cname, "category", decision.Category)
+			return dnsService.block(ctx, config, msg, decision), true
+		}
+	}
+	if config.RebindingProtection || len(config.BlockedIPRanges) > 0 {
+		if addr, decision := dnsService.inspectAddresses(config, domain, response); decision.Action == ActionBlock {
+			slog.Info("blocked domain by answer address", "domain", msg.Question[0].Name, "addr", addr, "category", decision.Category)
+			return dnsService.block(ctx, config, msg, decision), true
+		}
+	}
+	return response, false
+}
+
+// block builds the reply for a blocked query. Blocks answered with a custom
+// ip are recorded so that the block page served there can explain them.
+func (dnsService *DNSService) block(ctx context.Context, config *entity.Settings, msg *dns.Msg, decision Decision) *dns.Msg {
+	blockResponse := blockResponseFor(config, decision.Category)
+	if blockResponse.Mode == entity.BlockCustomIP {
+		client, _ := ClientAddrFromContext(ctx)
+		dnsService.blockLog.Record(client, BlockEvent{
+			Domain:     msg.Question[0].Name,
+			Category:   decision.Category,
+			PresetID:   config.ID,
+			PresetName: config.Name,
+			ReopensAt:  dnsService.filteringService.NextAllowedTime(config, decision.Category, time.Now().UTC()),
+			UTCOffset:  config.UTCOffset,
+		})
+	}
+	return blockedResponse(msg, blockResponse)
+}
+
+// interstitial points the query at the block page server which asks the
+// user to confirm. Without a block page server the domain is blocked.
+func (dnsService *DNSService) interstitial(ctx context.Context, config *entity.Settings, msg *dns.Msg, decision Decision) *dns.Msg {
+	if dnsService.interstitialResponse.IPv4 == "" && dnsService.interstitialResponse.IPv6 == "" {
+		return dnsService.block(ctx, config, msg, decision)
+	}
+	client, _ := ClientAddrFromContext(ctx)
+	dnsService.blockLog.Record(client, BlockEvent{
+		Domain:     msg.Question[0].Name,
+		Category:   decision.Category,
+		PresetID:   config.ID,
+		PresetName: config.Name,
+		UTCOffset:  config.UTCOffset,
+		SoftBlock:  true,
+	})
+	return blockedResponse(msg, dnsService.interstitialResponse)
+}
+
+// delay waits for d without holding up other queries. Once too many queries
+// are waiting, further queries are not delayed at all.
+func (dnsService *DNSService) delay(ctx context.Context, d time.Duration) error {
+	select {
+	case dnsService.delaySlots <- struct{}{}:
+		defer func() { <-dnsService.delaySlots }()
+	default:
+		slog.Warn("too many delayed queries, skipping delay")
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AllowSoftBlocked lets the client through to a domain it confirmed on the
+// interstitial page
+func (dnsService *DNSService) AllowSoftBlocked(ctx context.Context, event BlockEvent) error {
+	return dnsService.filteringService.AllowSoftBlocked(ctx, event.PresetID, event.Domain)
+}
+
+// LookupBlock returns the recent block of domain for the client
+func (dnsService *DNSService) LookupBlock(client netip.Addr, domain string) (BlockEvent, bool) {
+	return dnsService.blockLog.Lookup(client, domain)
+}
+
+// IssueBlockToken returns the token the client has to send back to confirm
+// the soft block of domain
+func (dnsService *DNSService) IssueBlockToken(client netip.Addr, domain string) (string, bool) {
+	return dnsService.blockLog.IssueToken(client, domain)
+}
+
+// ConfirmBlock returns the soft block of domain for the client when token is
+// the one issued to it
+func (dnsService *DNSService) ConfirmBlock(client netip.Addr, domain string, token string) (BlockEvent, bool) {
+	return dnsService.blockLog.Confirm(client, domain, token)
+}
+
+// qtypePolicyResponse builds the reply mandated by a query type policy
+func qtypePolicyResponse(msg *dns.Msg, policy entity.QTypePolicy) *dns.Msg {
+	if policy.Action == entity.QTypeRefuse {
+		return blockedResponse(msg, entity.BlockResponse{Mode: entity.BlockRefused})
+	}
+	return blockedResponse(msg, entity.BlockResponse{Mode: entity.BlockNoData})
+}
+
+// inspectCNAMEs evaluates every CNAME target of response against the preset
+// and returns the first chain member that is not allowed
+func (dnsService *DNSService) inspectCNAMEs(config *entity.Settings, response *dns.Msg) (string, Decision) {
+	for _, rr := range response.Answer {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		decision := dnsService.filteringService.Evaluate(config, cname.Target)
+		if decision.Action == ActionBlock {
+			return cname.Target, decision
+		}
+	}
+	return "", Decision{Action: ActionAllow}
+}
+
+// inspectAddresses evaluates every A/AAAA record of response against the
+// preset and returns the first address that is not allowed
+func (dnsService *DNSService) inspectAddresses(config *entity.Settings, domain string, response *dns.Msg) (netip.Addr, Decision) {
+	rule, _ := dnsService.forwarding.route(config, domain)
+	for _, rr := range response.Answer {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		decision := dnsService.filteringService.EvaluateAddress(config, domain, addr, rule != "")
+		if decision.Action == ActionBlock {
+			return addr, decision
+		}
+	}
+	return netip.Addr{}, Decision{Action: ActionAllow}
+}
+
+// resolve answers msg from cache or upstream servers. Apart from forwarding
+// rules and the upstream group no preset rules are applied. Upstreams get
+// the client subnet chosen by the ECS policy, and are asked for DNSSEC
+// records when answers are validated.
+func (dnsService *DNSService) resolve(ctx context.Context, config *entity.Settings, msg *dns.Msg) (*dns.Msg, error) {
+	query := dnsService.requestDNSSEC(dnsService.ecs.apply(ctx, msg))
+	response, err := dnsService.resolveQuery(ctx, config, query)
+	if err != nil {
+		return nil, err
+	}
+	dnsService.restoreDNSSEC(msg, response)
+	restoreEDNS(msg, response)
+	return response, nil
+}
+
+// resolveQuery answers msg from cache or upstream servers
+func (dnsService *DNSService) resolveQuery(ctx context.Context, config *entity.Settings, msg *dns.Msg) (*dns.Msg, error) {
+	route, selector := dnsService.route(config, msg.Question[0].Name)
 
 	//check in cache
 	key := createCacheKey(msg)
+	if route != "" {
+		// forwarded zones and filtering resolvers answer differently than
+		// the default servers
+		key = route + "|" + key
+	}
 	slog.Debug("checking cache for", "key", key)
-	cacheResponse, ok := dnsService.cache.Get(key)
+	cached, ok := dnsService.cache.Get(key)
+	if subnet := subnetOf(msg); subnet != nil {
+		// answers may hold for a wider subnet than the one of the query
+		for scope := int(subnet.SourceNetmask) - 1; scope >= 0 && !ok; scope-- {
+			cached, ok = dnsService.cache.Get(scopedKey(key, subnet, scope))
+		}
+	}
 	if ok {
-		elapsedTime := time.Since(startTime)
-		slog.Debug("replying back from cache", "elapsedTime", elapsedTime)
-		return cacheResponse.(CachedResponse).Response, nil
+		now := time.Now()
+		if cached.fresh(now) {
+			slog.Debug("replying back from cache", "key", key)
+			if dnsService.cacheConf.Prefetch && cached.popular(now) {
+				dnsService.prefetch(key, cached, msg, selector)
+			}
+			return cached.reply(msg, now), nil
+		}
+		return dnsService.serveStale(ctx, key, cached, msg, selector)
+	}
+
+	slog.Debug("querying upstream domain", "domainName", msg.Question[0].Name, "route", route)
+	return dnsService.fetchShared(ctx, key, msg, selector)
+}
+
+// rewrite answers msg with a CNAME to target followed by the records of
+// target itself
+func (dnsService *DNSService) rewrite(ctx context.Context, config *entity.Settings, msg *dns.Msg, target string) (*dns.Msg, error) {
+	question := msg.Question[0]
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	response.RecursionAvailable = true
+	response.Answer = append(response.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: safeSearchTTL},
+		Target: dns.Fqdn(target),
+	})
+	if question.Qtype == dns.TypeCNAME {
+		return response, nil
 	}
 
-	slog.Debug("querying upstream domain", "domainName", domain)
-	response, err := dnsService.QueryUpstream(msg)
+	targetMsg := new(dns.Msg)
+	targetMsg.SetQuestion(dns.Fqdn(target), question.Qtype)
+	targetMsg.RecursionDesired = true
+	targetResponse, err := dnsService.resolve(ctx, config, targetMsg)
 	if err != nil {
 		return nil, err
 	}
+	response.Answer = append(response.Answer, targetResponse.Answer...)
+	response.Rcode = targetResponse.Rcode
+	return response, nil
+}
 
-	//add to cache
-	leastTTL := uint32(math.MaxUint32)
-	for _, v := range response.Answer {
-		leastTTL = min(leastTTL, v.Header().Ttl)
+// stripECH removes ECH configs from HTTPS/SVCB records so that browsers
+// cannot hide the real server name from the filter. The response is copied
+// before modification.
+func stripECH(response *dns.Msg) *dns.Msg {
+	if !slices.ContainsFunc(response.Answer, hasECH) && !slices.ContainsFunc(response.Extra, hasECH) {
+		return response
 	}
-
-	cacheRes := CachedResponse{
-		Response: response,
-		CachedAt: time.Now(),
+	response = response.Copy()
+	for _, section := range [][]dns.RR{response.Answer, response.Extra} {
+		for _, rr := range section {
+			if svcb := svcbOf(rr); svcb != nil {
+				svcb.Value = slices.DeleteFunc(svcb.Value, func(kv dns.SVCBKeyValue) bool {
+					return kv.Key() == dns.SVCB_ECHCONFIG
+				})
+			}
+		}
 	}
-	slog.Debug("adding to cache", "key", key, "ttl", leastTTL)
-	dnsService.cache.SetWithTTL(key, cacheRes, time.Duration(leastTTL)*time.Second)
+	return response
+}
 
-	elapsedTime := time.Since(startTime)
-	slog.Debug("Replying back", "domain", domain, "rcode", response.Rcode, "elapsedTime", elapsedTime)
-	return response, nil
+func hasECH(rr dns.RR) bool {
+	svcb := svcbOf(rr)
+	return svcb != nil && slices.ContainsFunc(svcb.Value, func(kv dns.SVCBKeyValue) bool {
+		return kv.Key() == dns.SVCB_ECHCONFIG
+	})
+}
+
+func svcbOf(rr dns.RR) *dns.SVCB {
+	switch v := rr.(type) {
+	case *dns.SVCB:
+		return v
+	case *dns.HTTPS:
+		return &v.SVCB
+	}
+	return nil
 }
 
 func (dnsService *DNSService) QueryUpstream(msg *dns.Msg) (*dns.Msg, error) {
-	c := new(dns.Client)
-	c.Net = "udp"
+	return dnsService.queryServers(context.Background(), msg, dnsService.upstreamServerSelector)
+}
+
+// Close closes the connections to upstream servers
+func (dnsService *DNSService) Close() {
+	dnsService.upstreams.Close()
+}
 
-	// Set a timeout to prevent hanging
-	c.Timeout = 5 * time.Second
+// queryServers sends msg to the servers the selector picks. Failed queries
+// are retried on other servers.
+func (dnsService *DNSService) queryServers(ctx context.Context, msg *dns.Msg, selector *DNSServerSelector) (*dns.Msg, error) {
+	var tried []string
+	var lastErr error
+	for range maxQueryAttempts {
+		servers := selector.Pick(msg.Question[0].Name, tried)
+		if len(servers) == 0 {
+			break
+		}
+		tried = append(tried, servers...)
 
-	upstreamServer := dnsService.upstreamServerSelector.GetNext()
+		response, err := dnsService.race(ctx, msg, selector, servers)
+		if err == nil {
+			return response, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no upstream server available")
+	}
+	return nil, lastErr
+}
+
+// race sends msg to all servers at once and returns the first answer
+func (dnsService *DNSService) race(ctx context.Context, msg *dns.Msg, selector *DNSServerSelector, servers []string) (*dns.Msg, error) {
+	if len(servers) == 1 {
+		return dnsService.exchange(ctx, msg, selector, servers[0])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		response *dns.Msg
+		err      error
+	}
+	results := make(chan result, len(servers))
+	for _, server := range servers {
+		go func() {
+			response, err := dnsService.exchange(ctx, msg.Copy(), selector, server)
+			results <- result{response, err}
+		}()
+	}
+	var lastErr error
+	for range servers {
+		r := <-results
+		if r.err == nil {
+			return r.response, nil
+		}
+		lastErr = r.err
+	}
+	return nil, lastErr
+}
+
+// exchange sends msg to server and reports the outcome to selector
+func (dnsService *DNSService) exchange(ctx context.Context, msg *dns.Msg, selector *DNSServerSelector, upstreamServer string) (*dns.Msg, error) {
+	u, err := dnsService.upstreams.Get(upstreamServer)
+	if err != nil {
+		selector.ReportFailure(upstreamServer, err)
+		return nil, err
+	}
 	// Forward to upstream DNS server
-	response, _, err := c.Exchange(msg, fmt.Sprintf("%s:%d", upstreamServer, 53))
+	startTime := time.Now()
+	response, err := u.Exchange(ctx, msg)
 	if err != nil {
 		if dnsService.verbose {
 			log.Printf("Error querying upstream DNS: %v", err)
 		}
-
-		// If UDP fails, try TCP
-		c.Net = "tcp"
-		response, _, err = c.Exchange(msg, fmt.Sprintf("%s:%d", upstreamServer, 53))
-		if err != nil {
-			return nil, err
+		// a cancelled query says nothing about the server
+		if ctx.Err() == nil {
+			selector.ReportFailure(upstreamServer, err)
 		}
+		return nil, err
 	}
+	selector.ReportSuccess(upstreamServer, time.Since(startTime))
 
-	if dnsService.verbose && response != nil {
+	if dnsService.verbose {
 		log.Printf("Got response with code: %s, %d answers", dns.RcodeToString[response.Rcode], len(response.Answer))
 	}
 	slog.Debug("request processed by", "upstreamServer", upstreamServer)
 	return response, nil
 }
 
-// DNSServerSelector manages the round-robin selection of DNS servers
+// DNSServerSelector manages the selection of DNS servers, round-robin
+// unless another strategy is configured
 type DNSServerSelector struct {
-	servers []string
-	current uint32
-	mu      sync.RWMutex
+	servers  []string
+	current  uint32
+	mu       sync.RWMutex
+	health   map[string]*serverHealth
+	drained  map[string]bool
+	strategy strategy
+	fanout   int
 }
 
 func NewDNSServerSelector(servers []string) *DNSServerSelector {
 	return &DNSServerSelector{
-		servers: servers,
+		servers:  servers,
+		health:   make(map[string]*serverHealth),
+		drained:  make(map[string]bool),
+		strategy: roundRobinStrategy{},
+		fanout:   1,
 	}
 }
 
 // GetNext returns the next DNS server in round-robin fashion
 func (s *DNSServerSelector) GetNext() string {
-	// Get the current length of servers slice
 	s.mu.RLock()
-	length := uint32(len(s.servers))
-	s.mu.RUnlock()
-
-	// Read current value first, then increment
-	current := atomic.LoadUint32(&s.current)
-	atomic.AddUint32(&s.current, 1)
-	index := current % length
+	defer s.mu.RUnlock()
+	candidates := s.candidates(nil)
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[0]
+}
 
-	// Get the server at calculated index
+// Pick returns the servers a query for qname is sent to, skipping the
+// servers in exclude. It returns several servers when they are raced.
+func (s *DNSServerSelector) Pick(qname string, exclude []string) []string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.servers[index]
+	candidates := s.candidates(exclude)
+	if len(candidates) == 0 {
+		return nil
+	}
+	candidates = s.strategy.order(candidates, strings.ToLower(qname), s.health)
+	return candidates[:min(s.fanout, len(candidates))]
+}
+
+// candidates returns the healthy servers neither drained nor in exclude in
+// round-robin order. Unhealthy servers are only returned when no healthy
+// server is left. s.mu must be held.
+func (s *DNSServerSelector) candidates(exclude []string) []string {
+	// Read current value first, then increment
+	current := atomic.AddUint32(&s.current, 1) - 1
+
+	length := uint32(len(s.servers))
+	now := time.Now()
+	var healthy, unhealthy []string
+	for i := range length {
+		server := s.servers[(current+i)%length]
+		if s.drained[server] || slices.Contains(exclude, server) {
+			continue
+		}
+		if s.health[server].available(now) {
+			healthy = append(healthy, server)
+		} else {
+			unhealthy = append(unhealthy, server)
+		}
+	}
+	if len(healthy) == 0 && len(unhealthy) > 0 {
+		return unhealthy[:1]
+	}
+	return healthy
 }
 
 // AddServer adds a new DNS server to the pool
-func (s *DNSServerSelector) AddServer(server string) {
+func (s *DNSServerSelector) AddServer(server string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if slices.Contains(s.servers, server) {
+		return fmt.Errorf("%w: %s is already an upstream", apperrors.ErrInvalidInput, server)
+	}
 	s.servers = append(s.servers, server)
+	return nil
 }
 
-// RemoveServer removes a DNS server from the pool
-func (s *DNSServerSelector) RemoveServer(server string) bool {
+// RemoveServer removes a DNS server from the pool. The last server that is
+// not drained cannot be removed.
+func (s *DNSServerSelector) RemoveServer(server string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for i, srv := range s.servers {
-		if srv == server {
-			// Remove the server by slicing
-			s.servers = append(s.servers[:i], s.servers[i+1:]...)
-			// Ensure we still have at least one server
-			if len(s.servers) == 0 {
-				panic("cannot remove last DNS server")
-			}
-			return true
+	i := slices.Index(s.servers, server)
+	if i < 0 {
+		return apperrors.ErrNotFound
+	}
+	// Ensure we still have at least one server
+	if !s.drained[server] && s.activeServers() == 1 {
+		return apperrors.ErrLastUpstream
+	}
+	s.servers = slices.Delete(s.servers, i, i+1)
+	delete(s.health, server)
+	delete(s.drained, server)
+	return nil
+}
+
+// DrainServer takes a DNS server out of rotation without removing it, or
+// puts it back when drained is false
+func (s *DNSServerSelector) DrainServer(server string, drained bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !slices.Contains(s.servers, server) {
+		return apperrors.ErrNotFound
+	}
+	if !drained {
+		delete(s.drained, server)
+		return nil
+	}
+	if !s.drained[server] && s.activeServers() == 1 {
+		return apperrors.ErrLastUpstream
+	}
+	s.drained[server] = true
+	return nil
+}
+
+// ReorderServers changes the order of the pool. servers must hold every
+// server of the pool exactly once.
+func (s *DNSServerSelector) ReorderServers(servers []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sorted, current := slices.Clone(servers), slices.Clone(s.servers)
+	slices.Sort(sorted)
+	slices.Sort(current)
+	if !slices.Equal(sorted, current) {
+		return fmt.Errorf("%w: order must list every upstream once", apperrors.ErrInvalidInput)
+	}
+	s.servers = slices.Clone(servers)
+	return nil
+}
+
+// activeServers counts the servers that are not drained, s.mu must be held
+func (s *DNSServerSelector) activeServers() int {
+	active := 0
+	for _, server := range s.servers {
+		if !s.drained[server] {
+			active++
 		}
 	}
-	return false
+	return active
 }
 
 // GetServers returns a copy of the current server list
@@ -194,3 +686,30 @@ func (s *DNSServerSelector) GetServers() []string {
 	copy(servers, s.servers)
 	return servers
 }
+
+// GetUpstreams returns the servers of the pool with their drain state
+func (s *DNSServerSelector) GetUpstreams() []entity.Upstream {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	upstreams := make([]entity.Upstream, 0, len(s.servers))
+	for _, server := range s.servers {
+		upstreams = append(upstreams, entity.Upstream{Address: server, Drained: s.drained[server]})
+	}
+	return upstreams
+}
+
+// SetUpstreams replaces the servers of the pool
+func (s *DNSServerSelector) SetUpstreams(upstreams []entity.Upstream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.servers = make([]string, 0, len(upstreams))
+	s.drained = make(map[string]bool)
+	for _, upstream := range upstreams {
+		s.servers = append(s.servers, upstream.Address)
+		if upstream.Drained {
+			s.drained[upstream.Address] = true
+		}
+	}
+}
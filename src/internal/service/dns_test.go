@@ -1,11 +1,17 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"net"
 	"reflect"
 	"testing"
 
 	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/apperrors"
+	"github.com/quaintdev/webshield/src/internal/entity"
+	"github.com/quaintdev/webshield/src/internal/repository"
+	"github.com/quaintdev/webshield/src/internal/upstream"
 )
 
 func TestDNSService_QueryUpstream(t *testing.T) {
@@ -59,6 +65,7 @@ func TestDNSService_QueryUpstream(t *testing.T) {
 				upstreamServerSelector: tt.fields.upstreamServerSelector,
 				filteringService:       tt.fields.filteringService,
 				verbose:                tt.fields.verbose,
+				upstreams:              upstream.NewPool(upstream.Options{}),
 			}
 			got, err := dnsService.QueryUpstream(tt.args.msg)
 			if (err != nil) != tt.wantErr {
@@ -71,3 +78,165 @@ func TestDNSService_QueryUpstream(t *testing.T) {
 		})
 	}
 }
+
+func TestStripECH(t *testing.T) {
+	rr, err := dns.NewRR(`crypto.cloudflare.com. 300 IN HTTPS 1 . alpn="h3,h2" ech=AEX+DQBBpQAgACB/7zQ= ipv4hint=162.159.137.85`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := new(dns.Msg)
+	response.SetQuestion("crypto.cloudflare.com.", dns.TypeHTTPS)
+	response.Answer = append(response.Answer, rr)
+
+	got := stripECH(response)
+	if hasECH(got.Answer[0]) {
+		t.Errorf("stripECH() kept ech config in %v", got.Answer[0])
+	}
+	if len(got.Answer[0].(*dns.HTTPS).Value) != 2 {
+		t.Errorf("stripECH() = %v, want alpn and ipv4hint only", got.Answer[0])
+	}
+	if !hasECH(response.Answer[0]) {
+		t.Errorf("stripECH() modified the original response")
+	}
+}
+
+func TestDNSService_inspectCNAMEs(t *testing.T) {
+	domainStore := repository.NewDomainDataSTore()
+	domainStore.AddDomain("tracker.com", "Trackers")
+	dnsService := &DNSService{filteringService: NewFilteringService(nil, domainStore)}
+	config := &entity.Settings{
+		Enabled:    true,
+		Categories: map[string]entity.Category{"Trackers": entity.Black},
+	}
+
+	response := new(dns.Msg)
+	response.SetQuestion("metrics.allowed-site.com.", dns.TypeA)
+	for _, s := range []string{
+		"metrics.allowed-site.com. 300 IN CNAME edge.allowed-site.com.",
+		"edge.allowed-site.com. 300 IN CNAME a1.tracker.com.",
+		"a1.tracker.com. 300 IN A 192.0.2.1",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Answer = append(response.Answer, rr)
+	}
+
+	cname, decision := dnsService.inspectCNAMEs(config, response)
+	if cname != "a1.tracker.com." || decision.Action != ActionBlock || decision.Category != "Trackers" {
+		t.Errorf("DNSService.inspectCNAMEs() = %v, %v, want a1.tracker.com. blocked by Trackers", cname, decision)
+	}
+}
+
+func TestDNSService_ProcessQuery_inspectsEveryAnswer(t *testing.T) {
+	// the stand-in upstream cloaks cdn.example. behind a tracker and
+	// resolves the safe search host to a private address
+	server := startStandIn(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		var records []string
+		switch r.Question[0].Name {
+		case "cdn.example.":
+			records = []string{"cdn.example. 300 IN CNAME a1.tracker.com.", "a1.tracker.com. 300 IN A 192.0.2.1"}
+		case googleSafeSearchHost + ".":
+			records = []string{googleSafeSearchHost + ". 300 IN A 10.0.0.7"}
+		}
+		for _, record := range records {
+			rr, _ := dns.NewRR(record)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	domainStore := repository.NewDomainDataSTore()
+	domainStore.AddDomain("tracker.com", "Trackers")
+	config := &entity.Settings{
+		ID:                  "preset",
+		Enabled:             true,
+		SafeSearch:          true,
+		InspectCNAME:        true,
+		RebindingProtection: true,
+		Categories:          map[string]entity.Category{"Trackers": entity.Black},
+	}
+	dnsService := newCachingDNSService(server, &CacheConf{})
+	defer dnsService.Close()
+	dnsService.filteringService = NewFilteringService(memorySettingsRepo{"preset": config}, domainStore)
+	dnsService.rewriteStore = NewRewriteStore(memoryRewriteRepo{
+		"preset": {
+			{Domain: "printer.home.example", Type: dns.TypeA, Value: "192.168.1.20"},
+			{Domain: "assets.example", Type: dns.TypeCNAME, Value: "cdn.example"},
+		},
+	})
+	dnsService.blockLog = NewBlockLog()
+
+	tests := []struct {
+		name      string
+		domain    string
+		wantRcode int
+		wantCount int
+	}{
+		{name: "upstream answer of a local cname", domain: "assets.example.", wantRcode: dns.RcodeNameError},
+		{name: "upstream answer of the safe search host", domain: "www.google.com.", wantRcode: dns.RcodeNameError},
+		{name: "local record is exempt", domain: "printer.home.example.", wantRcode: dns.RcodeSuccess, wantCount: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetQuestion(tt.domain, dns.TypeA)
+			got, err := dnsService.ProcessQuery(context.Background(), msg, "preset")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Rcode != tt.wantRcode || len(got.Answer) != tt.wantCount {
+				t.Errorf("DNSService.ProcessQuery() = %v, want rcode %s with %d records", got, dns.RcodeToString[tt.wantRcode], tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestDNSServerSelector_manage(t *testing.T) {
+	selector := NewDNSServerSelector([]string{"10.0.0.1"})
+	if err := selector.AddServer("tls://9.9.9.9"); err != nil {
+		t.Fatal(err)
+	}
+	if err := selector.AddServer("tls://9.9.9.9"); !errors.Is(err, apperrors.ErrInvalidInput) {
+		t.Errorf("DNSServerSelector.AddServer() error = %v, want duplicate rejected", err)
+	}
+
+	if err := selector.DrainServer("10.0.0.1", true); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if got := selector.GetNext(); got != "tls://9.9.9.9" {
+			t.Errorf("DNSServerSelector.GetNext() = %s, want drained server skipped", got)
+		}
+	}
+	if err := selector.DrainServer("tls://9.9.9.9", true); !errors.Is(err, apperrors.ErrLastUpstream) {
+		t.Errorf("DNSServerSelector.DrainServer() error = %v, want last server kept", err)
+	}
+	if err := selector.RemoveServer("tls://9.9.9.9"); !errors.Is(err, apperrors.ErrLastUpstream) {
+		t.Errorf("DNSServerSelector.RemoveServer() error = %v, want last server kept", err)
+	}
+	if err := selector.RemoveServer("10.0.0.9"); !errors.Is(err, apperrors.ErrNotFound) {
+		t.Errorf("DNSServerSelector.RemoveServer() error = %v, want not found", err)
+	}
+
+	if err := selector.ReorderServers([]string{"10.0.0.1"}); !errors.Is(err, apperrors.ErrInvalidInput) {
+		t.Errorf("DNSServerSelector.ReorderServers() error = %v, want incomplete order rejected", err)
+	}
+	if err := selector.ReorderServers([]string{"tls://9.9.9.9", "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []entity.Upstream{{Address: "tls://9.9.9.9"}, {Address: "10.0.0.1", Drained: true}}
+	if got := selector.GetUpstreams(); !reflect.DeepEqual(got, want) {
+		t.Errorf("DNSServerSelector.GetUpstreams() = %v, want %v", got, want)
+	}
+
+	// a drained server can be removed as long as another one is in rotation
+	if err := selector.RemoveServer("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := selector.GetServers(); !reflect.DeepEqual(got, []string{"tls://9.9.9.9"}) {
+		t.Errorf("DNSServerSelector.GetServers() = %v, want only tls://9.9.9.9", got)
+	}
+}
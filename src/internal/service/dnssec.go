@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+
+	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/dnssec"
+)
+
+// DNSSECConf enables validation of upstream answers
+type DNSSECConf struct {
+	Enabled bool
+	// TrustAnchors are DS records of the root zone in presentation format,
+	// the root keys published by IANA when empty
+	TrustAnchors []string
+}
+
+// newValidator returns nil when validation is disabled
+func newValidator(conf *DNSSECConf) (*dnssec.Validator, error) {
+	if !conf.Enabled {
+		return nil, nil
+	}
+	if len(conf.TrustAnchors) == 0 {
+		return dnssec.NewValidator(dnssec.RootAnchors()), nil
+	}
+	anchors, err := dnssec.ParseAnchors(conf.TrustAnchors)
+	if err != nil {
+		return nil, err
+	}
+	return dnssec.NewValidator(anchors), nil
+}
+
+// requestDNSSEC returns a copy of msg asking upstreams for DNSSEC records
+// when answers are validated. Without validation msg is returned as is.
+func (dnsService *DNSService) requestDNSSEC(msg *dns.Msg) *dns.Msg {
+	if dnsService.validator == nil {
+		return msg
+	}
+	query := msg.Copy()
+	if opt := query.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		query.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return query
+}
+
+// validating reports whether the answer to msg from the servers of selector
+// is to be validated. Clients setting CD validate answers themselves.
+// Forwarded zones are usually internal ones the public chain of trust knows
+// nothing about, they are treated as insecure like zones below a negative
+// trust anchor.
+func (dnsService *DNSService) validating(msg *dns.Msg, selector *DNSServerSelector) bool {
+	return dnsService.validator != nil && !msg.CheckingDisabled && !dnsService.forwarded(selector)
+}
+
+// forwarded reports whether selector holds the servers of a forwarding rule
+func (dnsService *DNSService) forwarded(selector *DNSServerSelector) bool {
+	if selector == dnsService.upstreamServerSelector {
+		return false
+	}
+	for _, group := range dnsService.upstreamGroups {
+		if selector == group {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks response, the answer to msg obtained with checking
+// disabled. Bogus answers are replaced by SERVFAIL with an extended error
+// telling why, others get the AD bit set when they are secure. The keys and
+// delegations of the chain of trust always come from the default servers.
+func (dnsService *DNSService) validate(ctx context.Context, msg *dns.Msg, response *dns.Msg) *dns.Msg {
+	exchange := func(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+		return dnsService.queryServers(ctx, query, dnsService.upstreamServerSelector)
+	}
+	result := dnsService.validator.Validate(ctx, exchange, response)
+	if result.Security == dnssec.Bogus {
+		slog.Warn("DNSSEC validation failed", "domain", msg.Question[0].Name, "reason", result.Reason)
+		failure := new(dns.Msg)
+		failure.SetRcode(msg, dns.RcodeServerFailure)
+		failure.RecursionAvailable = true
+		if clientOpt := msg.IsEdns0(); clientOpt != nil {
+			failure.SetEdns0(clientOpt.UDPSize(), clientOpt.Do())
+			opt := failure.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: result.InfoCode, ExtraText: result.Reason})
+		}
+		return failure
+	}
+	response.AuthenticatedData = result.Security == dnssec.Secure
+	response.CheckingDisabled = msg.CheckingDisabled
+	return response
+}
+
+// restoreDNSSEC removes from response the DNSSEC records requestDNSSEC asked
+// for on behalf of clients that did not. The AD bit is only kept for
+// clients asking for it or for DNSSEC records.
+func (dnsService *DNSService) restoreDNSSEC(msg *dns.Msg, response *dns.Msg) {
+	if dnsService.validator == nil {
+		return
+	}
+	if !msg.AuthenticatedData && (msg.IsEdns0() == nil || !msg.IsEdns0().Do()) {
+		response.AuthenticatedData = false
+	}
+	if msg.IsEdns0() != nil && msg.IsEdns0().Do() {
+		return
+	}
+	qtype := msg.Question[0].Qtype
+	dnssecRecord := func(rr dns.RR) bool {
+		switch rrtype := rr.Header().Rrtype; rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			return rrtype != qtype
+		}
+		return false
+	}
+	response.Answer = slices.DeleteFunc(response.Answer, dnssecRecord)
+	response.Ns = slices.DeleteFunc(response.Ns, dnssecRecord)
+	response.Extra = slices.DeleteFunc(response.Extra, dnssecRecord)
+	if opt := response.IsEdns0(); opt != nil {
+		opt.SetDo(false)
+	}
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/dnssec"
+	"github.com/quaintdev/webshield/src/internal/entity"
+)
+
+// signedHandler serves a root zone signed with key, where secure. is signed
+// and bogus. carries a signature by another key. Like a validating resolver
+// it only returns bogus answers when checking is disabled.
+func signedHandler(t *testing.T) (dns.HandlerFunc, *dns.DNSKEY) {
+	t.Helper()
+	newKey := func() (*dns.DNSKEY, crypto.Signer) {
+		key := &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     dns.ZONE | dns.SEP,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		private, err := key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, private.(crypto.Signer)
+	}
+	key, signer := newKey()
+	otherKey, otherSigner := newKey()
+	sign := func(key *dns.DNSKEY, signer crypto.Signer, rrs ...dns.RR) []dns.RR {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: rrs[0].Header().Ttl},
+			Algorithm:  key.Algorithm,
+			SignerName: ".",
+			KeyTag:     key.KeyTag(),
+			Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+			Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		}
+		if err := sig.Sign(signer, rrs); err != nil {
+			t.Fatal(err)
+		}
+		return append(rrs, sig)
+	}
+	a := func(name string) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)}
+	}
+	records := map[string][]dns.RR{
+		".":       sign(key, signer, key),
+		"secure.": sign(key, signer, a("secure.")),
+		"bogus.":  sign(otherKey, otherSigner, a("bogus.")),
+	}
+
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.SetEdns0(dns.DefaultMsgSize, true)
+		name := r.Question[0].Name
+		if name == "bogus." && !r.CheckingDisabled {
+			m.Rcode = dns.RcodeServerFailure
+		} else {
+			m.Answer = records[name]
+		}
+		w.WriteMsg(m)
+	}, key
+}
+
+func TestDNSService_resolveDNSSEC(t *testing.T) {
+	handler, key := signedHandler(t)
+	dnsService := newCachingDNSService(startStandIn(t, handler), &CacheConf{})
+	defer dnsService.Close()
+	dnsService.validator = dnssec.NewValidator([]*dns.DS{key.ToDS(dns.SHA256)})
+
+	resolve := func(name string, edns, do, ad, cd bool) *dns.Msg {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.AuthenticatedData = ad
+		msg.CheckingDisabled = cd
+		if edns {
+			msg.SetEdns0(dns.DefaultMsgSize, do)
+		}
+		response, err := dnsService.resolve(context.Background(), &entity.Settings{}, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	signed := func(response *dns.Msg) bool {
+		for _, rr := range response.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				return true
+			}
+		}
+		return false
+	}
+
+	response := resolve("secure.", false, false, false, false)
+	if response.Rcode != dns.RcodeSuccess || response.AuthenticatedData || signed(response) {
+		t.Errorf("DNSService.resolve() = %v, want plain answer for client without DNSSEC", response)
+	}
+	response = resolve("secure.", false, false, true, false)
+	if !response.AuthenticatedData || signed(response) {
+		t.Errorf("DNSService.resolve() = %v, want AD for client setting AD", response)
+	}
+	response = resolve("secure.", true, true, false, false)
+	if !response.AuthenticatedData || !signed(response) {
+		t.Errorf("DNSService.resolve() = %v, want signed answer with AD for client setting DO", response)
+	}
+
+	response = resolve("bogus.", true, false, false, false)
+	if response.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("DNSService.resolve() = %v, want SERVFAIL for bogus answer", response)
+	}
+	var ede *dns.EDNS0_EDE
+	for _, option := range response.IsEdns0().Option {
+		if option, ok := option.(*dns.EDNS0_EDE); ok {
+			ede = option
+		}
+	}
+	if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeDNSBogus {
+		t.Errorf("DNSService.resolve() = %v, want extended error DNSSEC Bogus", response)
+	}
+	if response := resolve("bogus.", false, false, false, false); response.Rcode != dns.RcodeServerFailure || response.IsEdns0() != nil {
+		t.Errorf("DNSService.resolve() = %v, want SERVFAIL without OPT record", response)
+	}
+
+	// clients disabling checking validate answers themselves
+	response = resolve("bogus.", true, true, false, true)
+	if response.Rcode != dns.RcodeSuccess || response.AuthenticatedData || !signed(response) {
+		t.Errorf("DNSService.resolve() = %v, want unvalidated answer for client setting CD", response)
+	}
+}
+
+func TestDNSService_resolveDNSSECRoutes(t *testing.T) {
+	handler, key := signedHandler(t)
+	dnsService := newCachingDNSService(startStandIn(t, handler), &CacheConf{})
+	defer dnsService.Close()
+	dnsService.validator = dnssec.NewValidator([]*dns.DS{key.ToDS(dns.SHA256)})
+
+	// an internal server knowing nothing about the root zone
+	internal := startStandIn(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Name == "nas.internal." {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(10, 0, 0, 5),
+			})
+		}
+		w.WriteMsg(m)
+	})
+	dnsService.forwarding = newForwardingRouter([]entity.ForwardingRule{{Domain: "internal", Servers: []string{internal}}})
+	// a resolver of an upstream group refusing to answer for the root zone
+	group := startStandIn(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "." {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
+		handler(w, r)
+	})
+	dnsService.upstreamGroups = map[string]*DNSServerSelector{"group": NewDNSServerSelector([]string{group})}
+
+	resolve := func(config *entity.Settings, name string) *dns.Msg {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.SetEdns0(dns.DefaultMsgSize, true)
+		response, err := dnsService.resolve(context.Background(), config, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	response := resolve(&entity.Settings{}, "nas.internal.")
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 || response.AuthenticatedData {
+		t.Errorf("DNSService.resolve() = %v, want forwarded answer treated as insecure", response)
+	}
+	response = resolve(&entity.Settings{UpstreamGroup: "group"}, "secure.")
+	if response.Rcode != dns.RcodeSuccess || !response.AuthenticatedData {
+		t.Errorf("DNSService.resolve() = %v, want chain of trust fetched from the default servers", response)
+	}
+}
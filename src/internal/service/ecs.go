@@ -0,0 +1,187 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ECSStrip   = "strip"
+	ECSForward = "forward"
+	ECSFixed   = "fixed"
+
+	// defaultECSPrefix4 and defaultECSPrefix6 truncate forwarded client
+	// addresses unless configured otherwise
+	defaultECSPrefix4 = 24
+	defaultECSPrefix6 = 56
+)
+
+// ECSConf selects the EDNS Client Subnet sent to upstreams
+type ECSConf struct {
+	// Mode is "strip" to send no subnet, "forward" to send the subnet of the
+	// client or "fixed" to send Subnet. Subnets are stripped when empty.
+	Mode string
+	// IPv4Prefix and IPv6Prefix truncate forwarded client addresses, 24 and
+	// 56 by default
+	IPv4Prefix int
+	IPv6Prefix int
+	// Subnet is sent in fixed mode, such as "198.51.100.0/24"
+	Subnet string
+}
+
+// ecsPolicy applies ECSConf to upstream queries
+type ecsPolicy struct {
+	mode    string
+	prefix4 int
+	prefix6 int
+	fixed   netip.Prefix
+}
+
+func newECSPolicy(conf *ECSConf) (*ecsPolicy, error) {
+	policy := &ecsPolicy{mode: conf.Mode, prefix4: conf.IPv4Prefix, prefix6: conf.IPv6Prefix}
+	switch conf.Mode {
+	case "":
+		policy.mode = ECSStrip
+	case ECSStrip:
+	case ECSForward:
+		if policy.prefix4 == 0 {
+			policy.prefix4 = defaultECSPrefix4
+		}
+		if policy.prefix6 == 0 {
+			policy.prefix6 = defaultECSPrefix6
+		}
+		if policy.prefix4 < 0 || policy.prefix4 > 32 || policy.prefix6 < 0 || policy.prefix6 > 128 {
+			return nil, fmt.Errorf("invalid client subnet prefix /%d or /%d", policy.prefix4, policy.prefix6)
+		}
+	case ECSFixed:
+		fixed, err := netip.ParsePrefix(conf.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client subnet %q: %w", conf.Subnet, err)
+		}
+		policy.fixed = fixed.Masked()
+	default:
+		return nil, fmt.Errorf("unknown client subnet mode %q", conf.Mode)
+	}
+	return policy, nil
+}
+
+// subnet returns the subnet to send for the client of ctx
+func (p *ecsPolicy) subnet(ctx context.Context) (netip.Prefix, bool) {
+	switch p.mode {
+	case ECSForward:
+		client, ok := ClientAddrFromContext(ctx)
+		if !ok {
+			return netip.Prefix{}, false
+		}
+		bits := p.prefix6
+		if client.Is4() {
+			bits = p.prefix4
+		}
+		prefix, err := client.Prefix(bits)
+		return prefix, err == nil
+	case ECSFixed:
+		return p.fixed, true
+	}
+	return netip.Prefix{}, false
+}
+
+// apply returns a copy of msg carrying the subnet chosen by the policy in
+// place of the subnet sent by the client. Without policy msg is returned as
+// is.
+func (p *ecsPolicy) apply(ctx context.Context, msg *dns.Msg) *dns.Msg {
+	if p == nil {
+		return msg
+	}
+	query := msg.Copy()
+	subnet, ok := p.subnet(ctx)
+	opt := query.IsEdns0()
+	if opt == nil {
+		if !ok {
+			return query
+		}
+		query.SetEdns0(dns.DefaultMsgSize, false)
+		opt = query.IsEdns0()
+	}
+	opt.Option = slices.DeleteFunc(opt.Option, isSubnetOption)
+	if ok {
+		option := &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        2,
+			SourceNetmask: uint8(subnet.Bits()),
+			Address:       net.IP(subnet.Addr().AsSlice()),
+		}
+		if subnet.Addr().Is4() {
+			option.Family = 1
+		}
+		opt.Option = append(opt.Option, option)
+	}
+	return query
+}
+
+// restoreEDNS removes what apply added to the query of the client from
+// response. Clients that did not ask with a subnet get none back, and
+// clients without EDNS get no OPT record.
+func restoreEDNS(msg *dns.Msg, response *dns.Msg) {
+	clientOpt := msg.IsEdns0()
+	if clientOpt == nil {
+		response.Extra = slices.DeleteFunc(response.Extra, func(rr dns.RR) bool {
+			return rr.Header().Rrtype == dns.TypeOPT
+		})
+		return
+	}
+	if slices.ContainsFunc(clientOpt.Option, isSubnetOption) {
+		return
+	}
+	if opt := response.IsEdns0(); opt != nil {
+		opt.Option = slices.DeleteFunc(opt.Option, isSubnetOption)
+	}
+}
+
+func isSubnetOption(option dns.EDNS0) bool {
+	return option.Option() == dns.EDNS0SUBNET
+}
+
+// subnetOf returns the client subnet option of msg
+func subnetOf(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// subnetKey names the first bits of subnet in cache keys, * standing for
+// every subnet
+func subnetKey(subnet *dns.EDNS0_SUBNET, bits int) string {
+	if bits == 0 {
+		return "*"
+	}
+	if addr, ok := netip.AddrFromSlice(subnet.Address); ok {
+		if prefix, err := addr.Unmap().Prefix(bits); err == nil {
+			return prefix.String()
+		}
+	}
+	return subnet.Address.String() + "/" + strconv.Itoa(bits)
+}
+
+// scopedKey turns the cache key of a query with a client subnet into the
+// key of answers valid for the first bits of the subnet (RFC 7871 section
+// 7.3)
+func scopedKey(key string, subnet *dns.EDNS0_SUBNET, bits int) string {
+	if i := strings.LastIndex(key, "|ecs="); i >= 0 {
+		return key[:i] + "|ecs=" + subnetKey(subnet, bits)
+	}
+	return key
+}
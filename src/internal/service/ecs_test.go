@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/entity"
+)
+
+func TestECSPolicy_apply(t *testing.T) {
+	withSubnet := new(dns.Msg)
+	withSubnet.SetQuestion("example.com.", dns.TypeA)
+	withSubnet.SetEdns0(dns.DefaultMsgSize, false)
+	opt := withSubnet.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.IPv4(192, 0, 2, 9)})
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+
+	client4 := WithClientAddr(context.Background(), netip.MustParseAddr("203.0.113.77"))
+	client6 := WithClientAddr(context.Background(), netip.MustParseAddr("2001:db8:aaaa:bbcc:1::1"))
+	tests := []struct {
+		name string
+		conf ECSConf
+		ctx  context.Context
+		msg  *dns.Msg
+		want string
+	}{
+		{name: "strip", ctx: client4, msg: withSubnet, want: ""},
+		{name: "forward ipv4", conf: ECSConf{Mode: ECSForward}, ctx: client4, msg: plain, want: "203.0.113.0/24"},
+		{name: "forward ipv6", conf: ECSConf{Mode: ECSForward}, ctx: client6, msg: plain, want: "2001:db8:aaaa:bb00::/56"},
+		{name: "forward replaces client subnet", conf: ECSConf{Mode: ECSForward, IPv4Prefix: 16}, ctx: client4, msg: withSubnet, want: "203.0.0.0/16"},
+		{name: "forward without client", conf: ECSConf{Mode: ECSForward}, ctx: context.Background(), msg: withSubnet, want: ""},
+		{name: "fixed", conf: ECSConf{Mode: ECSFixed, Subnet: "198.51.100.7/24"}, ctx: client4, msg: plain, want: "198.51.100.0/24"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := newECSPolicy(&tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := policy.apply(tt.ctx, tt.msg)
+			var got string
+			if subnet := subnetOf(query); subnet != nil {
+				addr, _ := netip.AddrFromSlice(subnet.Address)
+				got = netip.PrefixFrom(addr.Unmap(), int(subnet.SourceNetmask)).String()
+			}
+			if got != tt.want {
+				t.Errorf("ecsPolicy.apply() subnet = %q, want %q", got, tt.want)
+			}
+			if query == tt.msg {
+				t.Error("ecsPolicy.apply() changed query of the client")
+			}
+		})
+	}
+
+	for _, conf := range []ECSConf{{Mode: "random"}, {Mode: ECSFixed, Subnet: "198.51.100.7"}, {Mode: ECSForward, IPv4Prefix: 33}} {
+		if _, err := newECSPolicy(&conf); err == nil {
+			t.Errorf("newECSPolicy(%+v) error = nil, want invalid configuration", conf)
+		}
+	}
+}
+
+// geoHandler answers geo.example. with an address per /24 client subnet,
+// region.example. with an address per /16 and other names alike for every
+// client
+func geoHandler(queries *atomic.Int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		ip := net.IPv4(192, 0, 2, 1)
+		if subnet := subnetOf(r); subnet != nil {
+			scope := uint8(0)
+			switch r.Question[0].Name {
+			case "geo.example.":
+				scope = subnet.SourceNetmask
+				ip = net.IPv4(192, 0, 2, subnet.Address.To4()[2])
+			case "region.example.":
+				scope = 16
+				ip = net.IPv4(192, 0, 2, subnet.Address.To4()[1])
+			}
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: subnet.SourceNetmask, SourceScope: scope, Address: subnet.Address,
+			})
+		}
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   ip,
+		})
+		w.WriteMsg(m)
+	}
+}
+
+func TestDNSService_resolveECS(t *testing.T) {
+	var queries atomic.Int32
+	dnsService := newCachingDNSService(startStandIn(t, geoHandler(&queries)), &CacheConf{})
+	defer dnsService.Close()
+	dnsService.ecs, _ = newECSPolicy(&ECSConf{Mode: ECSForward})
+
+	resolve := func(client, name string) *dns.Msg {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		ctx := WithClientAddr(context.Background(), netip.MustParseAddr(client))
+		response, err := dnsService.resolve(ctx, &entity.Settings{}, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.IsEdns0() != nil {
+			t.Errorf("DNSService.resolve() = %v, want no OPT record for client without EDNS", response)
+		}
+		return response
+	}
+	address := func(response *dns.Msg) string {
+		return response.Answer[0].(*dns.A).A.String()
+	}
+
+	if got := address(resolve("203.0.113.7", "geo.example.")); got != "192.0.2.113" {
+		t.Errorf("DNSService.resolve() = %s, want answer for 203.0.113.0/24", got)
+	}
+	if got := address(resolve("203.0.113.8", "geo.example.")); got != "192.0.2.113" {
+		t.Errorf("DNSService.resolve() = %s, want cached answer for 203.0.113.0/24", got)
+	}
+	if got := address(resolve("198.51.100.7", "geo.example.")); got != "192.0.2.100" {
+		t.Errorf("DNSService.resolve() = %s, want answer for 198.51.100.0/24", got)
+	}
+	if got := queries.Load(); got != 2 {
+		t.Errorf("upstream received %d queries, want one per subnet", got)
+	}
+
+	// answers with scope 0 are shared by all subnets
+	resolve("203.0.113.7", "www.example.")
+	resolve("198.51.100.7", "www.example.")
+	if got := queries.Load(); got != 3 {
+		t.Errorf("upstream received %d queries, want scope 0 answer cached for all subnets", got)
+	}
+
+	// answers with scope /16 are shared by the /24 subnets within
+	if got := address(resolve("203.0.113.7", "region.example.")); got != "192.0.2.0" {
+		t.Errorf("DNSService.resolve() = %s, want answer for 203.0.0.0/16", got)
+	}
+	if got := address(resolve("203.0.5.7", "region.example.")); got != "192.0.2.0" {
+		t.Errorf("DNSService.resolve() = %s, want cached answer for 203.0.0.0/16", got)
+	}
+	if got := address(resolve("198.51.100.7", "region.example.")); got != "192.0.2.51" {
+		t.Errorf("DNSService.resolve() = %s, want answer for 198.51.0.0/16", got)
+	}
+	if got := queries.Load(); got != 5 {
+		t.Errorf("upstream received %d queries, want one per /16 subnet", got)
+	}
+}
@@ -4,62 +4,227 @@ import (
 	"context"
 	"log"
 	"log/slog"
+	"net/netip"
+	"strings"
 	"time"
 
 	"github.com/quaintdev/webshield/src/internal/entity"
 	"github.com/quaintdev/webshield/src/internal/repository"
 )
 
+// Action tells DNSService how a query has to be answered
+type Action int
+
+const (
+	ActionAllow Action = iota
+	ActionBlock
+	ActionRewrite
+	// ActionInterstitial redirects to a page asking the user to confirm
+	ActionInterstitial
+	// ActionDelay resolves the domain normally after Decision.Delay
+	ActionDelay
+)
+
+// Decision is the outcome of evaluating a domain against a preset
+type Decision struct {
+	Action   Action
+	Category string
+	// Target is the CNAME target used when Action is ActionRewrite
+	Target string
+	// Delay is the wait before resolving when Action is ActionDelay
+	Delay time.Duration
+}
+
 type FilteringService struct {
 	settingsRepo repository.SettingsRepository
 	dnsRepo      repository.DomainDataRepository
+	bypassRepo   repository.DomainDataRepository
+	softBlocks   *softBlockGrants
+	visits       *visitCounter
 }
 
 func NewFilteringService(settings repository.SettingsRepository, dnsRepo repository.DomainDataRepository) *FilteringService {
 	return &FilteringService{
 		settingsRepo: settings,
 		dnsRepo:      dnsRepo,
+		bypassRepo:   newBypassDomainStore(),
+		softBlocks:   newSoftBlockGrants(),
+		visits:       newVisitCounter(),
 	}
 }
 
-func (s *FilteringService) IsDomainBlocked(ctx context.Context, settingId string, domainName string) (bool, error) {
-	domainName = removeLastPeriod(domainName)
+func (s *FilteringService) GetSettings(ctx context.Context, settingId string) (*entity.Settings, error) {
 	config, err := s.settingsRepo.GetConfig(ctx, settingId)
 	if err != nil {
-		log.Println("dnsService.IsDomainBlocked: ", err)
+		log.Println("dnsService.GetSettings: ", err)
+		return nil, err
+	}
+	return config, nil
+}
+
+func (s *FilteringService) IsDomainBlocked(ctx context.Context, settingId string, domainName string) (bool, error) {
+	config, err := s.GetSettings(ctx, settingId)
+	if err != nil {
 		return false, err
 	}
+	return s.Evaluate(config, domainName).Action == ActionBlock, nil
+}
+
+// Evaluate decides how a query for domainName is answered for the given preset
+func (s *FilteringService) Evaluate(config *entity.Settings, domainName string) Decision {
+	// lowercase so that mixed case queries cannot sidestep the rules
+	domainName = strings.ToLower(removeLastPeriod(domainName))
 
 	if !config.Enabled {
-		return false, nil
+		return Decision{Action: ActionAllow}
 	}
 
 	category := s.dnsRepo.GetDomainCategory(domainName)
 	if category == "" {
 		slog.Debug("domain not found in repository", "domainName", domainName)
-		return false, nil
 	}
 
 	switch config.Categories[category] {
 	case entity.Black:
 		slog.Debug("domain is blocked", "domainName", domainName)
-		return true, nil
+		return Decision{Action: ActionBlock, Category: category}
 	case entity.Blue:
 		// config has allowed access to domain as per schedule
-		now := time.Now().UTC()
-		startTime := config.WeekDayScheduleMap[now.Weekday()].StartTime
-		endTime := config.WeekDayScheduleMap[now.Weekday()].EndTime
-		allowedStartTime := time.Date(now.Year(), now.Month(), now.Day(), startTime.Hour(), startTime.Minute(), 0, 0, time.Local)
-		allowedEndTime := time.Date(now.Year(), now.Month(), now.Day(), endTime.Hour(), endTime.Minute(), 0, 0, time.Local)
-
-		// when time is outside allowed window
-		if !(now.After(allowedStartTime) && now.Before(allowedEndTime)) {
+		if !isWithinSchedule(config, time.Now().UTC()) {
 			slog.Debug("domain is blocked as per schedule", "domainName", domainName)
-			return true, nil
+			return Decision{Action: ActionBlock, Category: category}
 		}
 	}
 
-	return false, nil
+	// bypass prevention and safe search apply to domains the user may get
+	// through to after confirming or waiting as well
+	if config.BlockBypass && s.bypassRepo.GetDomainCategory(domainName) != "" {
+		slog.Debug("domain is blocked to prevent filter bypass", "domainName", domainName)
+		return Decision{Action: ActionBlock, Category: bypassCategory}
+	}
+
+	if config.SafeSearch {
+		if target := safeSearchTarget(domainName); target != "" {
+			slog.Debug("rewriting domain for safe search", "domainName", domainName, "target", target)
+			return Decision{Action: ActionRewrite, Category: category, Target: target}
+		}
+	}
+
+	switch config.Categories[category] {
+	case entity.Yellow:
+		if !s.softBlocks.isAllowed(config.ID, domainName, time.Now()) {
+			slog.Debug("domain requires confirmation", "domainName", domainName)
+			return Decision{Action: ActionInterstitial, Category: category}
+		}
+	case entity.Orange:
+		// the visit is only counted once the query is answered, see
+		// RecordVisit
+		visits := s.visits.peek(config, domainName, time.Now())
+		delay := delayFor(config, visits)
+		slog.Debug("domain is delayed", "domainName", domainName, "visits", visits, "delay", delay)
+		return Decision{Action: ActionDelay, Category: category, Delay: delay}
+	}
+
+	return Decision{Action: ActionAllow, Category: category}
+}
+
+// RecordVisit counts a query for domainName, delayed as per Evaluate, as a
+// visit of the domain
+func (s *FilteringService) RecordVisit(config *entity.Settings, domainName string) {
+	s.visits.record(config, strings.ToLower(removeLastPeriod(domainName)), time.Now())
+}
+
+// AllowSoftBlocked lets the user through to a domain of a yellow category
+// for the period configured in the preset
+func (s *FilteringService) AllowSoftBlocked(ctx context.Context, settingId string, domainName string) error {
+	config, err := s.GetSettings(ctx, settingId)
+	if err != nil {
+		return err
+	}
+	minutes := config.SoftBlockMinutes
+	if minutes <= 0 {
+		minutes = defaultSoftBlockMinutes
+	}
+	slog.Debug("allowing soft blocked domain", "settingId", settingId, "domainName", domainName, "minutes", minutes)
+	s.softBlocks.allow(settingId, domainName, time.Now().Add(time.Duration(minutes)*time.Minute))
+	return nil
+}
+
+// EvaluateAddress checks an address that domainName resolved to against the
+// response rules of the preset. Forwarded names are answered by the servers
+// of a forwarding rule, usually local ones, and may resolve to private
+// addresses.
+func (s *FilteringService) EvaluateAddress(config *entity.Settings, domainName string, addr netip.Addr, forwarded bool) Decision {
+	if !config.Enabled {
+		return Decision{Action: ActionAllow}
+	}
+	addr = addr.Unmap()
+
+	if config.RebindingProtection && isPrivateAddress(addr) && !forwarded && !isLocalDomain(domainName) {
+		slog.Debug("public domain resolved to private address", "domainName", domainName, "addr", addr)
+		return Decision{Action: ActionBlock, Category: rebindingCategory}
+	}
+
+	for _, v := range config.BlockedIPRanges {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			slog.Error("invalid blocked ip range", "range", v, "error", err)
+			continue
+		}
+		if prefix.Contains(addr) {
+			slog.Debug("domain resolved to blocked ip range", "domainName", domainName, "addr", addr, "range", v)
+			return Decision{Action: ActionBlock, Category: blockedRangeCategory}
+		}
+	}
+	return Decision{Action: ActionAllow}
+}
+
+// NextAllowedTime returns the start of the next scheduled window in which
+// domains of category are accessible. It returns zero time when the category
+// is not opened by the schedule within a week.
+func (s *FilteringService) NextAllowedTime(config *entity.Settings, category string, now time.Time) time.Time {
+	if config.Categories[category] != entity.Blue {
+		return time.Time{}
+	}
+	for i := 0; i <= 7; i++ {
+		day := now.AddDate(0, 0, i)
+		schedule, ok := config.WeekDayScheduleMap[day.Weekday()]
+		if !ok {
+			continue
+		}
+		start, end := scheduleWindow(schedule, day)
+		if start.After(now) && end.After(start) {
+			return start
+		}
+	}
+	return time.Time{}
+}
+
+// isWithinSchedule reports whether now falls in the allowed window of the
+// day, or in the window of the day before when it runs past midnight
+func isWithinSchedule(config *entity.Settings, now time.Time) bool {
+	for _, day := range []time.Time{now, now.AddDate(0, 0, -1)} {
+		schedule, ok := config.WeekDayScheduleMap[day.Weekday()]
+		if !ok {
+			continue
+		}
+		start, end := scheduleWindow(schedule, day)
+		if now.After(start) && now.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleWindow returns the window schedule allows on day. Windows ending
+// before they start, such as 22:00 to 02:00, end on the next day.
+func scheduleWindow(schedule entity.Schedule, day time.Time) (time.Time, time.Time) {
+	start := time.Date(day.Year(), day.Month(), day.Day(), schedule.StartTime.Hour(), schedule.StartTime.Minute(), 0, 0, time.Local)
+	end := time.Date(day.Year(), day.Month(), day.Day(), schedule.EndTime.Hour(), schedule.EndTime.Minute(), 0, 0, time.Local)
+	if end.Before(start) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end
 }
 
 func removeLastPeriod(s string) string {
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/quaintdev/webshield/src/internal/entity"
+	"github.com/quaintdev/webshield/src/internal/repository"
+)
+
+func TestFilteringService_Evaluate(t *testing.T) {
+	domainStore := repository.NewDomainDataSTore()
+	domainStore.AddDomain("facebook.com", "Social Media")
+	domainStore.AddDomain("reddit.com", "Forums")
+	domainStore.AddDomain("duckduckgo.com", "Search")
+	filteringService := NewFilteringService(nil, domainStore)
+
+	newConfig := func(safeSearch bool) *entity.Settings {
+		return &entity.Settings{
+			Enabled:            true,
+			SafeSearch:         safeSearch,
+			Categories:         map[string]entity.Category{"Social Media": entity.Black, "Forums": entity.Yellow, "Search": entity.Orange},
+			WeekDayScheduleMap: make(map[time.Weekday]entity.Schedule),
+		}
+	}
+
+	type args struct {
+		config     *entity.Settings
+		domainName string
+	}
+	tests := []struct {
+		name string
+		args args
+		want Decision
+	}{
+		{
+			name: "blocked category",
+			args: args{config: newConfig(false), domainName: "www.facebook.com."},
+			want: Decision{Action: ActionBlock, Category: "Social Media"},
+		},
+		{
+			name: "warn category",
+			args: args{config: newConfig(false), domainName: "www.reddit.com."},
+			want: Decision{Action: ActionInterstitial, Category: "Forums"},
+		},
+		{
+			name: "safe search disabled",
+			args: args{config: newConfig(false), domainName: "www.google.com."},
+			want: Decision{Action: ActionAllow},
+		},
+		{
+			name: "google country domain",
+			args: args{config: newConfig(true), domainName: "www.Google.co.uk."},
+			want: Decision{Action: ActionRewrite, Target: googleSafeSearchHost},
+		},
+		{
+			name: "youtube",
+			args: args{config: newConfig(true), domainName: "m.youtube.com."},
+			want: Decision{Action: ActionRewrite, Target: youtubeRestrictedHost},
+		},
+		{
+			name: "delayed search engine",
+			args: args{config: newConfig(false), domainName: "duckduckgo.com."},
+			want: Decision{Action: ActionDelay, Category: "Search", Delay: defaultDelaySeconds * time.Second},
+		},
+		{
+			name: "delayed search engine with safe search",
+			args: args{config: newConfig(true), domainName: "duckduckgo.com."},
+			want: Decision{Action: ActionRewrite, Category: "Search", Target: duckDuckGoSafeHost},
+		},
+		{
+			name: "doh canary with bypass prevention",
+			args: args{config: &entity.Settings{Enabled: true, BlockBypass: true}, domainName: "use-application-dns.net."},
+			want: Decision{Action: ActionBlock, Category: bypassCategory},
+		},
+		{
+			name: "public resolver subdomain with bypass prevention",
+			args: args{config: &entity.Settings{Enabled: true, BlockBypass: true}, domainName: "abc123.dns.nextdns.io."},
+			want: Decision{Action: ActionBlock, Category: bypassCategory},
+		},
+		{
+			name: "disabled preset",
+			args: args{config: &entity.Settings{SafeSearch: true}, domainName: "www.bing.com."},
+			want: Decision{Action: ActionAllow},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filteringService.Evaluate(tt.args.config, tt.args.domainName); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FilteringService.Evaluate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilteringService_RecordVisit(t *testing.T) {
+	domainStore := repository.NewDomainDataSTore()
+	domainStore.AddDomain("youtube.com", "Video")
+	filteringService := NewFilteringService(nil, domainStore)
+	config := &entity.Settings{
+		ID:                    "preset",
+		Enabled:               true,
+		Categories:            map[string]entity.Category{"Video": entity.Orange},
+		DelaySeconds:          5,
+		DelayIncrementSeconds: 10,
+	}
+
+	filteringService.visits.record(config, "youtube.com", time.Now().Add(-10*time.Minute))
+	// evaluating the query again, for the CNAME inspection or other query
+	// types, does not count another visit
+	for range 3 {
+		if got := filteringService.Evaluate(config, "www.youtube.com."); got.Delay != 15*time.Second {
+			t.Fatalf("FilteringService.Evaluate() = %v, want delay of the second visit", got)
+		}
+	}
+	filteringService.RecordVisit(config, "www.youtube.com.")
+	filteringService.RecordVisit(config, "youtube.com.")
+	if got := filteringService.Evaluate(config, "youtube.com."); got.Delay != 15*time.Second {
+		t.Errorf("FilteringService.Evaluate() = %v, want queries of one visit counted once", got)
+	}
+}
+
+func TestFilteringService_EvaluateAddress(t *testing.T) {
+	filteringService := NewFilteringService(nil, repository.NewDomainDataSTore())
+	config := &entity.Settings{
+		Enabled:             true,
+		RebindingProtection: true,
+		BlockedIPRanges:     []string{"203.0.113.0/24"},
+	}
+
+	type args struct {
+		domainName string
+		addr       string
+		forwarded  bool
+	}
+	tests := []struct {
+		name string
+		args args
+		want Decision
+	}{
+		{
+			name: "public address",
+			args: args{domainName: "example.com.", addr: "93.184.216.34"},
+			want: Decision{Action: ActionAllow},
+		},
+		{
+			name: "public name with private address",
+			args: args{domainName: "evil.example.com.", addr: "192.168.1.1"},
+			want: Decision{Action: ActionBlock, Category: rebindingCategory},
+		},
+		{
+			name: "public name with loopback v6 address",
+			args: args{domainName: "evil.example.com.", addr: "::1"},
+			want: Decision{Action: ActionBlock, Category: rebindingCategory},
+		},
+		{
+			name: "local name with private address",
+			args: args{domainName: "printer.home.arpa.", addr: "192.168.1.20"},
+			want: Decision{Action: ActionAllow},
+		},
+		{
+			name: "forwarded name with private address",
+			args: args{domainName: "nas.corp.example.com.", addr: "10.0.0.5", forwarded: true},
+			want: Decision{Action: ActionAllow},
+		},
+		{
+			name: "forwarded name in blocked range",
+			args: args{domainName: "ads.corp.example.com.", addr: "203.0.113.7", forwarded: true},
+			want: Decision{Action: ActionBlock, Category: blockedRangeCategory},
+		},
+		{
+			name: "blocked range",
+			args: args{domainName: "ads.example.com.", addr: "203.0.113.7"},
+			want: Decision{Action: ActionBlock, Category: blockedRangeCategory},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filteringService.EvaluateAddress(config, tt.args.domainName, netip.MustParseAddr(tt.args.addr), tt.args.forwarded)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FilteringService.EvaluateAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSoftBlockGrants(t *testing.T) {
+	grants := newSoftBlockGrants()
+	now := time.Now()
+	grants.allow("preset", "www.reddit.com.", now.Add(time.Minute))
+
+	if !grants.isAllowed("preset", "old.reddit.com", now) {
+		t.Errorf("softBlockGrants.isAllowed() = false for subdomain of confirmed domain")
+	}
+	if grants.isAllowed("other", "reddit.com", now) {
+		t.Errorf("softBlockGrants.isAllowed() = true for another preset")
+	}
+	if grants.isAllowed("preset", "reddit.com", now.Add(2*time.Minute)) {
+		t.Errorf("softBlockGrants.isAllowed() = true after the period ended")
+	}
+}
+
+func TestVisitCounterDelay(t *testing.T) {
+	config := &entity.Settings{ID: "preset", DelaySeconds: 5, DelayIncrementSeconds: 10}
+	counter := newVisitCounter()
+	now := time.Date(2025, time.March, 1, 10, 0, 0, 0, time.UTC)
+
+	// visits are recorded in order, each step depends on the previous ones
+	steps := []struct {
+		name string
+		at   time.Time
+		want time.Duration
+	}{
+		{name: "first visit", at: now, want: 5 * time.Second},
+		{name: "same visit", at: now.Add(30 * time.Second), want: 5 * time.Second},
+		{name: "second visit", at: now.Add(10 * time.Minute), want: 15 * time.Second},
+		{name: "third visit", at: now.Add(20 * time.Minute), want: 25 * time.Second},
+		{name: "fourth visit is capped", at: now.Add(30 * time.Minute), want: maxDelay},
+		{name: "next day", at: now.Add(24 * time.Hour), want: 5 * time.Second},
+	}
+	for _, step := range steps {
+		visits := counter.record(config, "www.youtube.com.", step.at)
+		if got := delayFor(config, visits); got != step.want {
+			t.Errorf("%s: delayFor() = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestSchedule_overnight(t *testing.T) {
+	clock := func(hour int) time.Time {
+		return time.Date(0, 1, 1, hour, 0, 0, 0, time.UTC)
+	}
+	config := &entity.Settings{
+		Categories: map[string]entity.Category{"Games": entity.Blue},
+		WeekDayScheduleMap: map[time.Weekday]entity.Schedule{
+			time.Friday:   {StartTime: clock(22), EndTime: clock(2)},
+			time.Saturday: {StartTime: clock(10), EndTime: clock(12)},
+		},
+	}
+	// 2025-03-07 is a Friday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2025, time.March, day, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		name       string
+		now        time.Time
+		wantWithin bool
+		wantNext   time.Time
+	}{
+		{name: "before the overnight window", now: at(7, 21, 0), wantNext: at(7, 22, 0)},
+		{name: "overnight window before midnight", now: at(7, 23, 0), wantWithin: true, wantNext: at(8, 10, 0)},
+		{name: "overnight window after midnight", now: at(8, 1, 30), wantWithin: true, wantNext: at(8, 10, 0)},
+		{name: "after the overnight window", now: at(8, 2, 30), wantNext: at(8, 10, 0)},
+		{name: "daytime window", now: at(8, 11, 0), wantWithin: true, wantNext: at(14, 22, 0)},
+	}
+	filteringService := NewFilteringService(nil, repository.NewDomainDataSTore())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isWithinSchedule(config, tt.now); got != tt.wantWithin {
+				t.Errorf("isWithinSchedule() = %v, want %v", got, tt.wantWithin)
+			}
+			if got := filteringService.NextAllowedTime(config, "Games", tt.now); !got.Equal(tt.wantNext) {
+				t.Errorf("FilteringService.NextAllowedTime() = %v, want %v", got, tt.wantNext)
+			}
+		})
+	}
+}
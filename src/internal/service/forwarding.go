@@ -0,0 +1,160 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quaintdev/webshield/src/internal/apperrors"
+	"github.com/quaintdev/webshield/src/internal/entity"
+	"github.com/quaintdev/webshield/src/internal/repository"
+	"github.com/quaintdev/webshield/src/internal/upstream"
+)
+
+// presetTableIdle is how long the rules of a preset nobody queries through
+// are kept
+const presetTableIdle = time.Hour
+
+// forwardingTable routes domains to the servers of the most specific
+// matching forwarding rule
+type forwardingTable struct {
+	rules     []entity.ForwardingRule
+	domains   *repository.DomainDataStore
+	selectors map[string]*DNSServerSelector
+	lastUsed  time.Time
+}
+
+// newForwardingTable builds the table of rules. Rules of presets may only
+// forward to plain addresses.
+func newForwardingTable(rules []entity.ForwardingRule, preset bool) *forwardingTable {
+	table := &forwardingTable{
+		rules:     rules,
+		domains:   repository.NewDomainDataSTore(),
+		selectors: make(map[string]*DNSServerSelector),
+	}
+	for _, rule := range rules {
+		domain := strings.ToLower(removeLastPeriod(rule.Domain))
+		var servers []string
+		for _, server := range rule.Servers {
+			if err := checkForwardingServer(server, preset); err != nil {
+				slog.Error("ignoring invalid forwarding server", "domain", rule.Domain, "error", err)
+				continue
+			}
+			servers = append(servers, server)
+		}
+		if domain == "" || len(servers) == 0 {
+			slog.Error("ignoring invalid forwarding rule", "domain", rule.Domain, "servers", rule.Servers)
+			continue
+		}
+		table.domains.AddDomain(domain, domain)
+		table.selectors[domain] = NewDNSServerSelector(servers)
+	}
+	return table
+}
+
+// route returns the rule matching domain and its server selector
+func (t *forwardingTable) route(domain string) (string, *DNSServerSelector) {
+	rule := t.domains.GetDomainCategory(domain)
+	if rule == "" {
+		return "", nil
+	}
+	return rule, t.selectors[rule]
+}
+
+// forwardingRouter picks the upstream servers of a query. Rules of the
+// preset take precedence over the global rules of config.json.
+type forwardingRouter struct {
+	global    *forwardingTable
+	mu        sync.Mutex
+	presets   map[string]*forwardingTable
+	lastPrune time.Time
+}
+
+func newForwardingRouter(rules []entity.ForwardingRule) *forwardingRouter {
+	return &forwardingRouter{
+		global:  newForwardingTable(rules, false),
+		presets: make(map[string]*forwardingTable),
+	}
+}
+
+// route returns the matching rule, empty when no rule matches
+func (r *forwardingRouter) route(config *entity.Settings, domain string) (string, *DNSServerSelector) {
+	domain = strings.ToLower(removeLastPeriod(domain))
+	if config != nil && len(config.ForwardingRules) > 0 {
+		if rule, selector := r.presetTable(config).route(domain); selector != nil {
+			return config.ID + ":" + rule, selector
+		}
+	}
+	return r.global.route(domain)
+}
+
+// presetTable returns the table of the preset, rebuilding it when the
+// preset rules changed. Tables of presets that were deleted or lost their
+// rules are dropped once idle.
+func (r *forwardingRouter) presetTable(config *entity.Settings) *forwardingTable {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.prune(now)
+	table, ok := r.presets[config.ID]
+	if !ok || !slices.EqualFunc(table.rules, config.ForwardingRules, func(a, b entity.ForwardingRule) bool {
+		return a.Domain == b.Domain && slices.Equal(a.Servers, b.Servers)
+	}) {
+		table = newForwardingTable(config.ForwardingRules, true)
+		r.presets[config.ID] = table
+	}
+	table.lastUsed = now
+	return table
+}
+
+// selectors returns the selectors of the global rules and of the preset
+// tables in use, under the keys route names them with
+func (r *forwardingRouter) selectors() map[string]*DNSServerSelector {
+	selectors := make(map[string]*DNSServerSelector, len(r.global.selectors))
+	for rule, selector := range r.global.selectors {
+		selectors[rule] = selector
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, table := range r.presets {
+		for rule, selector := range table.selectors {
+			selectors[id+":"+rule] = selector
+		}
+	}
+	return selectors
+}
+
+func (r *forwardingRouter) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < time.Minute {
+		return
+	}
+	r.lastPrune = now
+	for id, table := range r.presets {
+		if now.Sub(table.lastUsed) >= presetTableIdle {
+			delete(r.presets, id)
+		}
+	}
+}
+
+// checkForwardingServer checks a server the way upstreams added through the
+// API are checked. Presets are managed by their users and may only forward
+// to plain addresses.
+func checkForwardingServer(server string, preset bool) error {
+	if preset {
+		if _, err := netip.ParseAddrPort(server); err != nil {
+			if _, err := netip.ParseAddr(server); err != nil {
+				return fmt.Errorf("%w: forwarding server %s is not an ip address", apperrors.ErrInvalidInput, server)
+			}
+		}
+	}
+	u, err := upstream.New(server, upstream.Options{})
+	if err != nil {
+		return fmt.Errorf("%w: %v", apperrors.ErrInvalidInput, err)
+	}
+	u.Close()
+	return nil
+}
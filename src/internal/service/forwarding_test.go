@@ -0,0 +1,87 @@
+package service
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/quaintdev/webshield/src/internal/entity"
+)
+
+func TestForwardingRouter_route(t *testing.T) {
+	router := newForwardingRouter([]entity.ForwardingRule{
+		{Domain: "corp.example", Servers: []string{"10.0.0.53"}},
+		{Domain: "eu.corp.example", Servers: []string{"10.1.0.53"}},
+		{Domain: "*.lan", Servers: []string{"192.168.1.1"}},
+	})
+	config := &entity.Settings{
+		ID: "preset",
+		ForwardingRules: []entity.ForwardingRule{
+			{Domain: "dev.corp.example", Servers: []string{"10.2.0.53:5353"}},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		config     *entity.Settings
+		domain     string
+		wantRule   string
+		wantServer string
+	}{
+		{name: "suffix", domain: "intranet.corp.example.", wantRule: "corp.example", wantServer: "10.0.0.53"},
+		{name: "zone apex", domain: "corp.example.", wantRule: "corp.example", wantServer: "10.0.0.53"},
+		{name: "most specific", domain: "mail.EU.corp.example.", wantRule: "eu.corp.example", wantServer: "10.1.0.53"},
+		{name: "wildcard", domain: "router.lan.", wantRule: "*.lan", wantServer: "192.168.1.1"},
+		{name: "wildcard excludes apex", domain: "lan.", wantRule: ""},
+		{name: "no rule", domain: "example.com.", wantRule: ""},
+		{name: "preset rule", config: config, domain: "git.dev.corp.example.", wantRule: "preset:dev.corp.example", wantServer: "10.2.0.53:5353"},
+		{name: "preset falls back to global", config: config, domain: "intranet.corp.example.", wantRule: "corp.example", wantServer: "10.0.0.53"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, selector := router.route(tt.config, tt.domain)
+			if rule != tt.wantRule {
+				t.Errorf("forwardingRouter.route() rule = %q, want %q", rule, tt.wantRule)
+			}
+			if tt.wantServer == "" {
+				if selector != nil {
+					t.Errorf("forwardingRouter.route() selector = %v, want nil", selector.GetServers())
+				}
+				return
+			}
+			if selector == nil || selector.GetNext() != tt.wantServer {
+				t.Errorf("forwardingRouter.route() did not select %s", tt.wantServer)
+			}
+		})
+	}
+}
+
+func TestForwardingRouter_presetServers(t *testing.T) {
+	router := newForwardingRouter([]entity.ForwardingRule{
+		{Domain: "corp.example", Servers: []string{"tls://10.0.0.53"}},
+	})
+	config := &entity.Settings{
+		ID: "preset",
+		ForwardingRules: []entity.ForwardingRule{
+			{Domain: "dev.corp.example", Servers: []string{"https://internal.example/admin", "10.2.0.53"}},
+			{Domain: "ci.corp.example", Servers: []string{"recursive"}},
+		},
+	}
+
+	if _, selector := router.route(nil, "intranet.corp.example."); selector == nil || selector.GetNext() != "tls://10.0.0.53" {
+		t.Error("forwardingRouter.route() did not keep the url of a global rule")
+	}
+	if _, selector := router.route(config, "git.dev.corp.example."); selector == nil || !slices.Equal(selector.GetServers(), []string{"10.2.0.53"}) {
+		t.Error("forwardingRouter.route() did not drop the url of a preset rule")
+	}
+	if rule, _ := router.route(config, "build.ci.corp.example."); rule != "corp.example" {
+		t.Errorf("forwardingRouter.route() rule = %q, want preset rule without plain servers ignored", rule)
+	}
+
+	// the tables of presets nobody queries through are dropped
+	router.presets["preset"].lastUsed = time.Now().Add(-presetTableIdle)
+	router.prune(time.Now().Add(time.Minute))
+	if _, ok := router.presets["preset"]; ok {
+		t.Error("forwardingRouter.prune() kept the table of an idle preset")
+	}
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/dto"
+)
+
+const (
+	// failureThreshold consecutive failures take a server out of rotation
+	failureThreshold = 3
+	// circuitOpenPeriod is how long an unhealthy server stays out of
+	// rotation before queries try it again
+	circuitOpenPeriod = 30 * time.Second
+	// healthCheckInterval is the period of active probes
+	healthCheckInterval = 15 * time.Second
+	// maxQueryAttempts bounds the servers tried by a single query
+	maxQueryAttempts = 3
+	// latencyWeight is the weight of the latest measurement in the
+	// average latency of a server
+	latencyWeight = 0.3
+)
+
+// serverHealth tracks the outcome of queries to a server
+type serverHealth struct {
+	consecutiveFailures int
+	openUntil           time.Time
+	successes           uint64
+	failures            uint64
+	lastError           string
+	lastSuccess         time.Time
+	lastFailure         time.Time
+	// latency is the exponentially weighted average of response times
+	latency time.Duration
+}
+
+// available reports whether the server is in rotation at now
+func (h *serverHealth) available(now time.Time) bool {
+	return h == nil || !now.Before(h.openUntil)
+}
+
+// healthOf returns the health of server, s.mu must be held for writing
+func (s *DNSServerSelector) healthOf(server string) *serverHealth {
+	h, ok := s.health[server]
+	if !ok {
+		h = new(serverHealth)
+		s.health[server] = h
+	}
+	return h
+}
+
+// ReportSuccess records the response time of server and puts it back into
+// rotation
+func (s *DNSServerSelector) ReportSuccess(server string, rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.healthOf(server)
+	if h.consecutiveFailures >= failureThreshold {
+		slog.Info("upstream server recovered", "server", server)
+	}
+	h.consecutiveFailures = 0
+	h.openUntil = time.Time{}
+	h.successes++
+	h.lastSuccess = time.Now()
+	if h.latency == 0 {
+		h.latency = rtt
+	} else {
+		h.latency = time.Duration(latencyWeight*float64(rtt) + (1-latencyWeight)*float64(h.latency))
+	}
+}
+
+// ReportFailure records a failed query. Once failureThreshold queries failed
+// in a row, the server is taken out of rotation for circuitOpenPeriod.
+func (s *DNSServerSelector) ReportFailure(server string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	h := s.healthOf(server)
+	h.consecutiveFailures++
+	h.failures++
+	h.lastError = err.Error()
+	h.lastFailure = now
+	if h.consecutiveFailures >= failureThreshold && h.available(now) {
+		slog.Warn("upstream server is unhealthy", "server", server, "failures", h.consecutiveFailures, "error", err)
+		h.openUntil = now.Add(circuitOpenPeriod)
+	}
+}
+
+// Status returns the health of every server
+func (s *DNSServerSelector) Status() []dto.UpstreamStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	status := make([]dto.UpstreamStatus, 0, len(s.servers))
+	for _, server := range s.servers {
+		upstreamStatus := dto.UpstreamStatus{Address: server, Healthy: true, Drained: s.drained[server]}
+		if h, ok := s.health[server]; ok {
+			upstreamStatus.Healthy = h.available(now) && h.consecutiveFailures < failureThreshold
+			upstreamStatus.ConsecutiveFailures = h.consecutiveFailures
+			upstreamStatus.Successes = h.successes
+			upstreamStatus.Failures = h.failures
+			upstreamStatus.LastError = h.lastError
+			upstreamStatus.LatencyMs = float64(h.latency) / float64(time.Millisecond)
+			if lastSuccess := h.lastSuccess; !lastSuccess.IsZero() {
+				upstreamStatus.LastSuccess = &lastSuccess
+			}
+			if lastFailure := h.lastFailure; !lastFailure.IsZero() {
+				upstreamStatus.LastFailure = &lastFailure
+			}
+		}
+		status = append(status, upstreamStatus)
+	}
+	return status
+}
+
+// StartHealthChecks probes every upstream server periodically until ctx is
+// done. Probes bring servers back into rotation as soon as they recover.
+func (dnsService *DNSService) StartHealthChecks(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				dnsService.checkHealth(ctx)
+			}
+		}
+	}()
+}
+
+func (dnsService *DNSService) checkHealth(ctx context.Context) {
+	selectors := []*DNSServerSelector{dnsService.upstreamServerSelector}
+	for _, selector := range dnsService.upstreamGroups {
+		selectors = append(selectors, selector)
+	}
+	for _, selector := range dnsService.forwarding.selectors() {
+		selectors = append(selectors, selector)
+	}
+	var wg sync.WaitGroup
+	for _, selector := range selectors {
+		for _, server := range selector.GetServers() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				startTime := time.Now()
+				if err := dnsService.probe(ctx, server); err != nil {
+					if ctx.Err() == nil {
+						selector.ReportFailure(server, err)
+					}
+					return
+				}
+				selector.ReportSuccess(server, time.Since(startTime))
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// probe asks server for the root name servers
+func (dnsService *DNSService) probe(ctx context.Context, server string) error {
+	u, err := dnsService.upstreams.Get(server)
+	if err != nil {
+		return err
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+	msg.RecursionDesired = true
+	response, err := u.Exchange(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if response.Rcode == dns.RcodeServerFailure || response.Rcode == dns.RcodeRefused {
+		return fmt.Errorf("probe answered with %s", dns.RcodeToString[response.Rcode])
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/entity"
+	"github.com/quaintdev/webshield/src/internal/upstream"
+)
+
+func TestDNSServerSelector_circuit(t *testing.T) {
+	selector := NewDNSServerSelector([]string{"10.0.0.1", "10.0.0.2"})
+	for range failureThreshold {
+		selector.ReportFailure("10.0.0.1", errors.New("timeout"))
+	}
+	for range 4 {
+		if got := selector.GetNext(); got != "10.0.0.2" {
+			t.Errorf("DNSServerSelector.GetNext() = %s, want unhealthy server skipped", got)
+		}
+	}
+	if got := selector.Pick("example.com.", []string{"10.0.0.2"}); !slices.Equal(got, []string{"10.0.0.1"}) {
+		t.Errorf("DNSServerSelector.Pick() = %v, want unhealthy server as last resort", got)
+	}
+	if got := selector.Pick("example.com.", []string{"10.0.0.1", "10.0.0.2"}); got != nil {
+		t.Errorf("DNSServerSelector.Pick() = %v, want no server", got)
+	}
+
+	status := selector.Status()
+	if status[0].Healthy || status[0].ConsecutiveFailures != failureThreshold || !status[1].Healthy {
+		t.Errorf("DNSServerSelector.Status() = %+v, want first server unhealthy", status)
+	}
+
+	selector.ReportSuccess("10.0.0.1", time.Millisecond)
+	if status := selector.Status(); !status[0].Healthy {
+		t.Errorf("DNSServerSelector.Status() = %+v, want server recovered", status)
+	}
+}
+
+func TestDNSService_queryServersFailover(t *testing.T) {
+	live := startStandIn(t, answerAfter(0))
+
+	// nothing listens on the port of a closed socket
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := closed.LocalAddr().String()
+	closed.Close()
+
+	selector := NewDNSServerSelector([]string{dead, live})
+	dnsService := &DNSService{upstreams: upstream.NewPool(upstream.Options{})}
+	defer dnsService.Close()
+
+	for range 2 * failureThreshold {
+		msg := new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		if _, err := dnsService.queryServers(context.Background(), msg, selector); err != nil {
+			t.Fatalf("DNSService.queryServers() error = %v, want retry on healthy server", err)
+		}
+	}
+	status := selector.Status()
+	if status[0].Healthy || status[0].Failures != failureThreshold {
+		t.Errorf("DNSServerSelector.Status() = %+v, want dead server out of rotation after %d failures", status[0], failureThreshold)
+	}
+}
+
+func TestDNSService_checkHealthForwarding(t *testing.T) {
+	live := startStandIn(t, answerAfter(0))
+
+	// nothing listens on the port of a closed socket
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := closed.LocalAddr().String()
+	closed.Close()
+
+	dnsService := &DNSService{
+		upstreamServerSelector: NewDNSServerSelector(nil),
+		forwarding:             newForwardingRouter([]entity.ForwardingRule{{Domain: "corp.example", Servers: []string{live}}}),
+		upstreams:              upstream.NewPool(upstream.Options{}),
+	}
+	defer dnsService.Close()
+	config := &entity.Settings{
+		ID:              "preset",
+		ForwardingRules: []entity.ForwardingRule{{Domain: "home.lan", Servers: []string{dead}}},
+	}
+	dnsService.forwarding.route(config, "nas.home.lan.")
+
+	for range failureThreshold {
+		dnsService.checkHealth(context.Background())
+	}
+	status := dnsService.forwardingStatus()
+	if len(status) != 2 {
+		t.Fatalf("DNSService.forwardingStatus() = %+v, want the servers of both rules", status)
+	}
+	if status[0].Forwarding != "corp.example" || !status[0].Healthy || status[0].Successes != failureThreshold {
+		t.Errorf("DNSService.forwardingStatus() = %+v, want global rule server probed and healthy", status[0])
+	}
+	if status[1].Forwarding != "preset:home.lan" || status[1].Healthy || status[1].Failures != failureThreshold {
+		t.Errorf("DNSService.forwardingStatus() = %+v, want preset rule server probed and unhealthy", status[1])
+	}
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// inflightTimeout bounds upstream queries shared by several clients
+const inflightTimeout = 10 * time.Second
+
+// inflightQuery is an upstream query waited for by one or more clients
+type inflightQuery struct {
+	done     chan struct{}
+	response *dns.Msg
+	err      error
+}
+
+// inflightGroup coalesces identical upstream queries. While a query is in
+// flight, further queries with the same key wait for its response instead
+// of going upstream.
+type inflightGroup struct {
+	mu      sync.Mutex
+	queries map[string]*inflightQuery
+}
+
+// do runs query once for all callers asking for key at the same time. The
+// response is shared and must not be modified. query runs until it completes
+// or inflightTimeout passes, even if the caller that started it gives up.
+func (g *inflightGroup) do(ctx context.Context, key string, query func(context.Context) (*dns.Msg, error)) (*dns.Msg, error) {
+	g.mu.Lock()
+	if g.queries == nil {
+		g.queries = make(map[string]*inflightQuery)
+	}
+	q, ok := g.queries[key]
+	if !ok {
+		q = &inflightQuery{done: make(chan struct{})}
+		g.queries[key] = q
+		go g.run(ctx, key, q, query)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return q.response, q.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (g *inflightGroup) run(ctx context.Context, key string, q *inflightQuery, query func(context.Context) (*dns.Msg, error)) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), inflightTimeout)
+	defer cancel()
+	q.response, q.err = query(ctx)
+
+	g.mu.Lock()
+	delete(g.queries, key)
+	g.mu.Unlock()
+	close(q.done)
+}
+
+// fetchShared fetches msg like fetch, sharing the upstream query with
+// clients asking the same question at the same time
+func (dnsService *DNSService) fetchShared(ctx context.Context, key string, msg *dns.Msg, selector *DNSServerSelector) (*dns.Msg, error) {
+	// the query of the client must not be shared with other clients
+	query := msg.Copy()
+	response, err := dnsService.inflight.do(ctx, key, func(ctx context.Context) (*dns.Msg, error) {
+		return dnsService.fetch(ctx, key, query, selector)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replyTo(msg, response), nil
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestInflightGroup_do(t *testing.T) {
+	var g inflightGroup
+	var queries atomic.Int32
+	release := make(chan struct{})
+	query := func(ctx context.Context) (*dns.Msg, error) {
+		queries.Add(1)
+		<-release
+		return new(dns.Msg), nil
+	}
+
+	// the first caller gives up, the others still get the response
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := g.do(ctx, "key", query); err == nil {
+			t.Error("inflightGroup.do() error = nil, want cancelled")
+		}
+	}()
+	for queries.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	responses := make(chan *dns.Msg, 5)
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := g.do(context.Background(), "key", query)
+			if err != nil {
+				t.Error(err)
+			}
+			responses <- response
+		}()
+	}
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(responses)
+
+	if got := queries.Load(); got != 1 {
+		t.Errorf("query ran %d times, want 1", got)
+	}
+	for response := range responses {
+		if response == nil {
+			t.Error("inflightGroup.do() response = nil")
+		}
+	}
+
+	// completed queries are not shared
+	release = make(chan struct{})
+	close(release)
+	g.do(context.Background(), "key", query)
+	if got := queries.Load(); got != 2 {
+		t.Errorf("query ran %d times, want new query after completion", got)
+	}
+}
+
+func TestDNSService_fetchShared(t *testing.T) {
+	dnsService := newCachingDNSService(startStandIn(t, answerAfter(50*time.Millisecond)), &CacheConf{})
+	defer dnsService.Close()
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := new(dns.Msg)
+			msg.SetQuestion("example.com.", dns.TypeA)
+			response, err := dnsService.fetchShared(context.Background(), createCacheKey(msg), msg, dnsService.upstreamServerSelector)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if response.Id != msg.Id {
+				t.Errorf("DNSService.fetchShared() id = %d, want %d", response.Id, msg.Id)
+			}
+		}()
+	}
+	wg.Wait()
+	if status := dnsService.upstreamServerSelector.Status(); status[0].Successes != 1 {
+		t.Errorf("upstream answered %d queries, want 1", status[0].Successes)
+	}
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"net/netip"
+	"strings"
+)
+
+const (
+	// rebindingCategory is reported for public names resolving to private addresses
+	rebindingCategory = "DNS Rebinding"
+	// blockedRangeCategory is reported for answers inside a blocked ip range
+	blockedRangeCategory = "Blocked IP Range"
+)
+
+// localSuffixes are names that are expected to resolve to private addresses
+var localSuffixes = []string{"localhost", "local", "lan", "home", "home.arpa", "internal", "intranet"}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func isPrivateAddress(addr netip.Addr) bool {
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() ||
+		addr.IsUnspecified() || sharedAddressSpace.Contains(addr)
+}
+
+func isLocalDomain(domainName string) bool {
+	domainName = strings.ToLower(removeLastPeriod(domainName))
+	if !strings.Contains(domainName, ".") {
+		// single label names never leave the local network
+		return true
+	}
+	for _, suffix := range localSuffixes {
+		if domainName == suffix || strings.HasSuffix(domainName, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
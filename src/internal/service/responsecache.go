@@ -0,0 +1,242 @@
+package service
+
+import (
+	"container/list"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/dto"
+	"github.com/quaintdev/webshield/src/internal/entity"
+)
+
+// defaultCacheSize is the number of entries cached unless configured
+// otherwise
+const defaultCacheSize = 10000
+
+// cacheEntry is an element of the LRU list of responseCache
+type cacheEntry struct {
+	key       string
+	name      string
+	value     *CachedResponse
+	keepUntil time.Time
+}
+
+// responseCache holds responses up to a number of entries. The least
+// recently used entry is evicted to make room for new ones, and entries are
+// dropped once they are no longer kept.
+type responseCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	lru      *list.List
+
+	hits         atomic.Uint64
+	misses       atomic.Uint64
+	evictions    atomic.Uint64
+	staleAnswers atomic.Uint64
+	prefetches   atomic.Uint64
+}
+
+func newResponseCache(capacity int) *responseCache {
+	if capacity <= 0 {
+		capacity = defaultCacheSize
+	}
+	return &responseCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Get returns the response cached under key
+func (c *responseCache) Get(key string) (*CachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !time.Now().Before(entry.keepUntil) {
+		c.remove(element)
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	c.hits.Add(1)
+	return entry.value, true
+}
+
+// Set caches value under key for keep
+func (c *responseCache) Set(key string, value *CachedResponse, keep time.Duration) {
+	var name string
+	if len(value.Response.Question) > 0 {
+		name = strings.ToLower(value.Response.Question[0].Name)
+	}
+	entry := &cacheEntry{key: key, name: name, value: value, keepUntil: time.Now().Add(keep)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// remove drops element, c.mu must be held
+func (c *responseCache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).key)
+}
+
+// Flush drops the entries of names matching match, all entries when match is
+// nil. It returns the number of entries dropped.
+func (c *responseCache) Flush(match func(name string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if match == nil {
+		flushed := c.lru.Len()
+		c.entries = make(map[string]*list.Element)
+		c.lru.Init()
+		return flushed
+	}
+	flushed := 0
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		if match(element.Value.(*cacheEntry).name) {
+			c.remove(element)
+			flushed++
+		}
+		element = next
+	}
+	return flushed
+}
+
+// Entries returns the entries cached for name
+func (c *responseCache) Entries(name string) []dto.CacheEntry {
+	name = strings.ToLower(dns.Fqdn(name))
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var entries []dto.CacheEntry
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*cacheEntry)
+		if entry.name != name || !now.Before(entry.keepUntil) {
+			continue
+		}
+		response := entry.value.Response
+		item := dto.CacheEntry{
+			Key:       entry.key,
+			Type:      dns.TypeToString[response.Question[0].Qtype],
+			Rcode:     dns.RcodeToString[response.Rcode],
+			CachedAt:  entry.value.CachedAt,
+			ExpiresAt: entry.value.ExpiresAt,
+			Stale:     !entry.value.fresh(now),
+			Hits:      entry.value.hits.Load(),
+		}
+		for _, rr := range entry.value.reply(response, now).Answer {
+			item.Answer = append(item.Answer, rr.String())
+		}
+		entries = append(entries, item)
+	}
+	return entries
+}
+
+// Stats returns the size and counters of the cache
+func (c *responseCache) Stats() dto.CacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+	return dto.CacheStats{
+		Entries:      entries,
+		Capacity:     c.capacity,
+		Hits:         c.hits.Load(),
+		Misses:       c.misses.Load(),
+		Evictions:    c.evictions.Load(),
+		StaleAnswers: c.staleAnswers.Load(),
+		Prefetches:   c.prefetches.Load(),
+	}
+}
+
+// Snapshot returns the entries kept at now, least recently used first
+func (c *responseCache) Snapshot(now time.Time) []entity.CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make([]entity.CacheEntry, 0, c.lru.Len())
+	for element := c.lru.Back(); element != nil; element = element.Prev() {
+		entry := element.Value.(*cacheEntry)
+		if !now.Before(entry.keepUntil) {
+			continue
+		}
+		packed, err := entry.value.Response.Pack()
+		if err != nil {
+			slog.Warn("skipping cache entry", "key", entry.key, "error", err)
+			continue
+		}
+		entries = append(entries, entity.CacheEntry{
+			Key:       entry.key,
+			Response:  packed,
+			CachedAt:  entry.value.CachedAt,
+			ExpiresAt: entry.value.ExpiresAt,
+			KeepUntil: entry.keepUntil,
+		})
+	}
+	return entries
+}
+
+// Restore adds the entries of a snapshot that are still kept at now and
+// returns their number
+func (c *responseCache) Restore(entries []entity.CacheEntry, now time.Time) int {
+	restored := 0
+	for _, entry := range entries {
+		if !now.Before(entry.KeepUntil) {
+			continue
+		}
+		response := new(dns.Msg)
+		if err := response.Unpack(entry.Response); err != nil {
+			slog.Warn("skipping cache entry", "key", entry.Key, "error", err)
+			continue
+		}
+		c.Set(entry.Key, &CachedResponse{
+			Response:  response,
+			CachedAt:  entry.CachedAt,
+			ExpiresAt: entry.ExpiresAt,
+		}, entry.KeepUntil.Sub(now))
+		restored++
+	}
+	return restored
+}
+
+// CacheStats returns the size and counters of the DNS cache
+func (dnsService *DNSService) CacheStats() dto.CacheStats {
+	return dnsService.cache.Stats()
+}
+
+// CacheEntries returns the answers cached for name
+func (dnsService *DNSService) CacheEntries(name string) []dto.CacheEntry {
+	return dnsService.cache.Entries(name)
+}
+
+// FlushCache drops cached answers for name, for name and its subdomains when
+// suffix is set, or all answers when name is empty. It returns the number of
+// entries dropped.
+func (dnsService *DNSService) FlushCache(name string, suffix bool) int {
+	if name == "" {
+		return dnsService.cache.Flush(nil)
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	return dnsService.cache.Flush(func(cached string) bool {
+		return cached == name || (suffix && strings.HasSuffix(cached, "."+name))
+	})
+}
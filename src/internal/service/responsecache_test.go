@@ -0,0 +1,79 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func cachedAnswer(name string) *CachedResponse {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	return newCachedResponse(response, &CacheConf{}, 300, time.Now())
+}
+
+func TestResponseCache_evict(t *testing.T) {
+	cache := newResponseCache(2)
+	cache.Set("a", cachedAnswer("a.example."), time.Minute)
+	cache.Set("b", cachedAnswer("b.example."), time.Minute)
+	cache.Get("a")
+	cache.Set("c", cachedAnswer("c.example."), time.Minute)
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("responseCache.Get(b) found least recently used entry")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("responseCache.Get(%s) missing", key)
+		}
+	}
+	cache.Set("d", cachedAnswer("d.example."), -time.Second)
+	if _, ok := cache.Get("d"); ok {
+		t.Error("responseCache.Get(d) found entry no longer kept")
+	}
+
+	stats := cache.Stats()
+	if stats.Entries != 1 || stats.Evictions != 2 || stats.Hits != 3 || stats.Misses != 2 {
+		t.Errorf("responseCache.Stats() = %+v", stats)
+	}
+}
+
+func TestDNSService_FlushCache(t *testing.T) {
+	dnsService := &DNSService{cache: newResponseCache(0)}
+	fill := func() {
+		for _, name := range []string{"example.com.", "www.Example.com.", "notexample.com.", "example.org."} {
+			dnsService.cache.Set(name, cachedAnswer(name), time.Minute)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		domain string
+		suffix bool
+		want   int
+	}{
+		{name: "name", domain: "EXAMPLE.com", want: 1},
+		{name: "suffix", domain: "example.com", suffix: true, want: 2},
+		{name: "all", want: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fill()
+			if got := dnsService.FlushCache(tt.domain, tt.suffix); got != tt.want {
+				t.Errorf("DNSService.FlushCache() = %d, want %d", got, tt.want)
+			}
+			if got := dnsService.cache.Stats().Entries; got != 4-tt.want {
+				t.Errorf("%d entries left, want %d", got, 4-tt.want)
+			}
+			dnsService.FlushCache("", false)
+		})
+	}
+
+	fill()
+	if entries := dnsService.CacheEntries("www.example.com"); len(entries) != 1 || entries[0].Type != "A" {
+		t.Errorf("DNSService.CacheEntries() = %+v, want entry of www.example.com", entries)
+	}
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/entity"
+	"github.com/quaintdev/webshield/src/internal/repository"
+)
+
+const (
+	// localRecordTTL is the TTL of records answered from preset rewrites
+	localRecordTTL = 300
+	// maxLocalCNAMEs bounds CNAME chains between local records
+	maxLocalCNAMEs = 8
+)
+
+// presetRewrites holds the rewrites of one preset ready for lookups
+type presetRewrites struct {
+	// records maps domain patterns to their records
+	records map[string][]entity.Rewrite
+	// wildcards maps names to the wildcard pattern matching them
+	wildcards *repository.DomainDataStore
+}
+
+func newPresetRewrites(rewrites []entity.Rewrite) *presetRewrites {
+	p := &presetRewrites{
+		records:   make(map[string][]entity.Rewrite),
+		wildcards: repository.NewDomainDataSTore(),
+	}
+	for _, v := range rewrites {
+		p.records[v.Domain] = append(p.records[v.Domain], v)
+		if strings.HasPrefix(v.Domain, "*.") {
+			p.wildcards.AddDomain(v.Domain, v.Domain)
+		}
+	}
+	return p
+}
+
+// lookup returns the records of domain. Exact entries take precedence over
+// wildcards, of which the most specific one wins.
+func (p *presetRewrites) lookup(domain string) []entity.Rewrite {
+	if records, ok := p.records[domain]; ok {
+		return records
+	}
+	if pattern := p.wildcards.GetDomainCategory(domain); pattern != "" {
+		return p.records[pattern]
+	}
+	return nil
+}
+
+// RewriteStore keeps the local records of every preset. Rewrites are read
+// from the repository on first use and kept until they are updated.
+type RewriteStore struct {
+	rewriteRepo repository.RewriteRepository
+	mu          sync.RWMutex
+	presets     map[string]*presetRewrites
+}
+
+func NewRewriteStore(rewriteRepo repository.RewriteRepository) *RewriteStore {
+	return &RewriteStore{
+		rewriteRepo: rewriteRepo,
+		presets:     make(map[string]*presetRewrites),
+	}
+}
+
+func (s *RewriteStore) GetRewrites(ctx context.Context, configId string) ([]entity.Rewrite, error) {
+	return s.rewriteRepo.GetRewrites(ctx, configId)
+}
+
+func (s *RewriteStore) UpdateRewrites(ctx context.Context, configId string, rewrites []entity.Rewrite) error {
+	err := s.rewriteRepo.UpdateRewrites(ctx, configId, rewrites)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.presets[configId] = newPresetRewrites(rewrites)
+	return nil
+}
+
+func (s *RewriteStore) DeleteRewrites(ctx context.Context, configId string) error {
+	err := s.rewriteRepo.DeleteRewrites(ctx, configId)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.presets, configId)
+	return nil
+}
+
+// Lookup returns the local records of domain for the preset
+func (s *RewriteStore) Lookup(ctx context.Context, configId string, domain string) []entity.Rewrite {
+	domain = strings.ToLower(removeLastPeriod(domain))
+
+	s.mu.RLock()
+	preset, ok := s.presets[configId]
+	s.mu.RUnlock()
+	if !ok {
+		rewrites, err := s.rewriteRepo.GetRewrites(ctx, configId)
+		if err != nil {
+			slog.Error("failed to read rewrites", "configId", configId, "error", err)
+			return nil
+		}
+		preset = newPresetRewrites(rewrites)
+		s.mu.Lock()
+		// keep a concurrent update rather than overwriting it with older data
+		if current, ok := s.presets[configId]; ok {
+			preset = current
+		} else {
+			s.presets[configId] = preset
+		}
+		s.mu.Unlock()
+	}
+	return preset.lookup(domain)
+}
+
+// localAnswer answers msg authoritatively from the local records of the
+// preset. CNAME targets without local records are resolved upstream and
+// their answers inspected like any upstream answer. The local records
+// themselves are set by the preset and exempt from the inspections, so
+// they may point at private addresses.
+func (dnsService *DNSService) localAnswer(ctx context.Context, config *entity.Settings, msg *dns.Msg, records []entity.Rewrite) (*dns.Msg, error) {
+	question := msg.Question[0]
+	response := new(dns.Msg)
+	response.SetReply(msg)
+	response.Authoritative = true
+	response.RecursionAvailable = true
+
+	name := question.Name
+	for range maxLocalCNAMEs {
+		if len(records) == 1 && records[0].Type == dns.TypeCNAME {
+			target := dns.Fqdn(records[0].Value)
+			response.Answer = append(response.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: localRecordTTL},
+				Target: target,
+			})
+			if question.Qtype == dns.TypeCNAME {
+				return response, nil
+			}
+			name = target
+			records = dnsService.rewriteStore.Lookup(ctx, config.ID, target)
+			if records != nil {
+				continue
+			}
+
+			targetMsg := new(dns.Msg)
+			targetMsg.SetQuestion(target, question.Qtype)
+			targetMsg.RecursionDesired = true
+			targetResponse, err := dnsService.resolve(ctx, config, targetMsg)
+			if err != nil {
+				return nil, err
+			}
+			if blocked, ok := dnsService.inspect(ctx, config, msg, target, targetResponse); ok {
+				return blocked, nil
+			}
+			response.Answer = append(response.Answer, targetResponse.Answer...)
+			response.Ns = targetResponse.Ns
+			response.Rcode = targetResponse.Rcode
+			return response, nil
+		}
+
+		for _, v := range records {
+			if v.Type != question.Qtype {
+				continue
+			}
+			hdr := dns.RR_Header{Name: name, Rrtype: v.Type, Class: dns.ClassINET, Ttl: localRecordTTL}
+			switch v.Type {
+			case dns.TypeA:
+				response.Answer = append(response.Answer, &dns.A{Hdr: hdr, A: net.ParseIP(v.Value).To4()})
+			case dns.TypeAAAA:
+				response.Answer = append(response.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(v.Value)})
+			}
+		}
+		// the name exists but has no records of the question type
+		if len(response.Answer) == 0 {
+			response.Ns = append(response.Ns, synthesizeSOA(name, localRecordTTL))
+		}
+		return response, nil
+	}
+
+	slog.Warn("local CNAME chain too long", "domain", question.Name)
+	response.Answer = nil
+	response.Rcode = dns.RcodeServerFailure
+	return response, nil
+}
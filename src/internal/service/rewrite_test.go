@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/entity"
+)
+
+type memoryRewriteRepo map[string][]entity.Rewrite
+
+func (m memoryRewriteRepo) GetRewrites(ctx context.Context, configId string) ([]entity.Rewrite, error) {
+	return m[configId], nil
+}
+
+func (m memoryRewriteRepo) UpdateRewrites(ctx context.Context, configId string, rewrites []entity.Rewrite) error {
+	m[configId] = rewrites
+	return nil
+}
+
+func (m memoryRewriteRepo) DeleteRewrites(ctx context.Context, configId string) error {
+	delete(m, configId)
+	return nil
+}
+
+type memorySettingsRepo map[string]*entity.Settings
+
+func (m memorySettingsRepo) GetConfig(ctx context.Context, id string) (*entity.Settings, error) {
+	config, ok := m[id]
+	if !ok {
+		return nil, errors.New("no such config")
+	}
+	return config, nil
+}
+
+func (m memorySettingsRepo) UpdateConfig(ctx context.Context, config *entity.Settings) error {
+	m[config.ID] = config
+	return nil
+}
+
+func (m memorySettingsRepo) DeleteConfig(ctx context.Context, id string) error {
+	delete(m, id)
+	return nil
+}
+
+func (m memorySettingsRepo) GetAllConfigs(ctx context.Context) ([]*entity.Settings, error) {
+	var configs []*entity.Settings
+	for _, config := range m {
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func TestDNSService_localAnswer(t *testing.T) {
+	rewriteStore := NewRewriteStore(memoryRewriteRepo{
+		"preset": {
+			{Domain: "printer.home", Type: dns.TypeA, Value: "192.168.1.20"},
+			{Domain: "*.dev.local", Type: dns.TypeA, Value: "10.0.0.5"},
+			{Domain: "api.dev.local", Type: dns.TypeAAAA, Value: "fd00::5"},
+			{Domain: "nas.home", Type: dns.TypeCNAME, Value: "printer.home"},
+		},
+	})
+	dnsService := &DNSService{rewriteStore: rewriteStore}
+	config := &entity.Settings{ID: "preset"}
+
+	tests := []struct {
+		name   string
+		domain string
+		qtype  uint16
+		want   []string
+	}{
+		{
+			name:   "exact",
+			domain: "Printer.Home.",
+			qtype:  dns.TypeA,
+			want:   []string{"Printer.Home.\t300\tIN\tA\t192.168.1.20"},
+		},
+		{
+			name:   "wildcard",
+			domain: "web.dev.local.",
+			qtype:  dns.TypeA,
+			want:   []string{"web.dev.local.\t300\tIN\tA\t10.0.0.5"},
+		},
+		{
+			name:   "exact entry shadows wildcard",
+			domain: "api.dev.local.",
+			qtype:  dns.TypeA,
+			want:   nil,
+		},
+		{
+			name:   "local cname",
+			domain: "nas.home.",
+			qtype:  dns.TypeA,
+			want: []string{
+				"nas.home.\t300\tIN\tCNAME\tprinter.home.",
+				"printer.home.\t300\tIN\tA\t192.168.1.20",
+			},
+		},
+		{
+			name:   "no data",
+			domain: "printer.home.",
+			qtype:  dns.TypeAAAA,
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetQuestion(tt.domain, tt.qtype)
+			records := rewriteStore.Lookup(context.Background(), "preset", tt.domain)
+			if records == nil {
+				t.Fatalf("RewriteStore.Lookup() found no records for %s", tt.domain)
+			}
+			got, err := dnsService.localAnswer(context.Background(), config, msg, records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Authoritative || got.Rcode != dns.RcodeSuccess {
+				t.Errorf("DNSService.localAnswer() = %v, want authoritative NOERROR", got)
+			}
+			if len(got.Answer) != len(tt.want) {
+				t.Fatalf("DNSService.localAnswer() answer = %v, want %v", got.Answer, tt.want)
+			}
+			for i, rr := range got.Answer {
+				if rr.String() != tt.want[i] {
+					t.Errorf("DNSService.localAnswer() answer[%d] = %v, want %v", i, rr, tt.want[i])
+				}
+			}
+			if len(tt.want) == 0 && len(got.Ns) != 1 {
+				t.Errorf("DNSService.localAnswer() ns = %v, want SOA", got.Ns)
+			}
+		})
+	}
+
+	if records := rewriteStore.Lookup(context.Background(), "preset", "dev.local."); records != nil {
+		t.Errorf("RewriteStore.Lookup() = %v, want wildcard not to match its parent", records)
+	}
+}
+
+func TestDNSService_ProcessQuery_localRecordPolicy(t *testing.T) {
+	config := &entity.Settings{
+		ID:            "preset",
+		Enabled:       true,
+		QTypePolicies: map[uint16]entity.QTypePolicy{dns.TypeAAAA: {Action: entity.QTypeRefuse}},
+	}
+	dnsService := &DNSService{
+		filteringService: NewFilteringService(memorySettingsRepo{"preset": config}, nil),
+		rewriteStore: NewRewriteStore(memoryRewriteRepo{
+			"preset": {
+				{Domain: "printer.home", Type: dns.TypeA, Value: "192.168.1.20"},
+				{Domain: "printer.home", Type: dns.TypeAAAA, Value: "fd00::20"},
+			},
+		}),
+	}
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		wantRcode int
+		wantCount int
+	}{
+		{name: "allowed type", qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantCount: 1},
+		{name: "refused type", qtype: dns.TypeAAAA, wantRcode: dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetQuestion("printer.home.", tt.qtype)
+			got, err := dnsService.ProcessQuery(context.Background(), msg, "preset")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Rcode != tt.wantRcode || len(got.Answer) != tt.wantCount {
+				t.Errorf("DNSService.ProcessQuery() = %v, want rcode %s with %d records", got, dns.RcodeToString[tt.wantRcode], tt.wantCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSoftBlockMinutes applies when a preset has no period configured
+	defaultSoftBlockMinutes = 15
+	// InterstitialTTL is kept short so that clients pick up the real
+	// address soon after the user confirmed
+	InterstitialTTL = 5
+)
+
+// softBlockGrants tracks the domains a user clicked through per preset
+type softBlockGrants struct {
+	mu     sync.Mutex
+	grants map[string]time.Time
+}
+
+func newSoftBlockGrants() *softBlockGrants {
+	return &softBlockGrants{
+		grants: make(map[string]time.Time),
+	}
+}
+
+// allow grants access to domain and its subdomains until the given time
+func (g *softBlockGrants) allow(presetID string, domain string, until time.Time) {
+	domain = strings.TrimPrefix(strings.ToLower(removeLastPeriod(domain)), "www.")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for key, expiry := range g.grants {
+		if now.After(expiry) {
+			delete(g.grants, key)
+		}
+	}
+	g.grants[presetID+"|"+domain] = until
+}
+
+// isAllowed reports whether domain or one of its parents has an active grant
+func (g *softBlockGrants) isAllowed(presetID string, domain string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for domain != "" {
+		if until, ok := g.grants[presetID+"|"+domain]; ok && now.Before(until) {
+			return true
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+)
+
+const (
+	StrategyRoundRobin = "roundrobin"
+	StrategyFastest    = "fastest"
+	StrategyParallel   = "parallel"
+	StrategyWeighted   = "weighted"
+	StrategyHash       = "hash"
+
+	// defaultParallel is the number of servers raced by the parallel strategy
+	defaultParallel = 2
+	// exploreInterval is the number of queries after which the fastest
+	// strategy tries a slower server again
+	exploreInterval = 20
+)
+
+// UpstreamConf selects how queries are spread over the DNS servers
+type UpstreamConf struct {
+	// Strategy is one of "roundrobin", "fastest", "parallel", "weighted"
+	// or "hash"
+	Strategy string
+	// Parallel is the number of servers raced by the parallel strategy
+	Parallel int
+	// Weights of servers for the weighted strategy, 1 when missing
+	Weights map[string]int
+}
+
+// strategy orders the candidate servers of a query. Candidates come in
+// round-robin order and the first server returned is tried first.
+type strategy interface {
+	order(candidates []string, qname string, health map[string]*serverHealth) []string
+}
+
+// UseStrategy switches the selector to the configured strategy
+func (s *DNSServerSelector) UseStrategy(conf *UpstreamConf) error {
+	var st strategy
+	fanout := 1
+	switch conf.Strategy {
+	case "", StrategyRoundRobin:
+		st = roundRobinStrategy{}
+	case StrategyFastest:
+		st = &fastestStrategy{}
+	case StrategyParallel:
+		st = roundRobinStrategy{}
+		fanout = conf.Parallel
+		if fanout < 2 {
+			fanout = defaultParallel
+		}
+	case StrategyWeighted:
+		st = weightedStrategy{weights: conf.Weights}
+	case StrategyHash:
+		st = hashStrategy{}
+	default:
+		return fmt.Errorf("unknown upstream strategy %q", conf.Strategy)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.strategy, s.fanout = st, fanout
+	return nil
+}
+
+// roundRobinStrategy keeps the round-robin order
+type roundRobinStrategy struct{}
+
+func (roundRobinStrategy) order(candidates []string, _ string, _ map[string]*serverHealth) []string {
+	return candidates
+}
+
+// fastestStrategy prefers the server with the lowest average latency.
+// Servers without measurements go first so that they get measured. Every
+// exploreInterval queries, the slower servers take turns going first so
+// that a server that got faster again is noticed.
+type fastestStrategy struct {
+	queries atomic.Uint64
+}
+
+func (f *fastestStrategy) order(candidates []string, _ string, health map[string]*serverHealth) []string {
+	latency := func(server string) int64 {
+		if h := health[server]; h != nil {
+			return int64(h.latency)
+		}
+		return 0
+	}
+	slices.SortStableFunc(candidates, func(a, b string) int {
+		return int(min(max(latency(a)-latency(b), -1), 1))
+	})
+	if n := f.queries.Add(1); n%exploreInterval == 0 && len(candidates) > 1 {
+		i := 1 + int(n/exploreInterval)%(len(candidates)-1)
+		candidates[0], candidates[i] = candidates[i], candidates[0]
+	}
+	return candidates
+}
+
+// weightedStrategy picks the first server at random in proportion to its
+// weight
+type weightedStrategy struct {
+	weights map[string]int
+}
+
+func (w weightedStrategy) weight(server string) int {
+	return max(w.weights[server], 1)
+}
+
+func (w weightedStrategy) order(candidates []string, _ string, _ map[string]*serverHealth) []string {
+	total := 0
+	for _, server := range candidates {
+		total += w.weight(server)
+	}
+	n := rand.IntN(total)
+	for i, server := range candidates {
+		n -= w.weight(server)
+		if n < 0 {
+			candidates[0], candidates[i] = candidates[i], candidates[0]
+			break
+		}
+	}
+	return candidates
+}
+
+// hashStrategy sends every name to the same server so that the server
+// cache is hit more often. Rendezvous hashing moves only the names of a
+// server that became unavailable.
+type hashStrategy struct{}
+
+func (hashStrategy) order(candidates []string, qname string, _ map[string]*serverHealth) []string {
+	score := func(server string) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(server))
+		h.Write([]byte{0})
+		h.Write([]byte(qname))
+		return h.Sum64()
+	}
+	slices.SortFunc(candidates, func(a, b string) int {
+		sa, sb := score(a), score(b)
+		switch {
+		case sa > sb:
+			return -1
+		case sa < sb:
+			return 1
+		}
+		return 0
+	})
+	return candidates
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quaintdev/webshield/src/internal/upstream"
+)
+
+// startStandIn starts a DNS server answering queries with handler and
+// returns its address
+func startStandIn(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        conn,
+		NotifyStartedFunc: func() { close(started) },
+		Handler:           handler,
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+// answerAfter answers every query with an empty reply after delay
+func answerAfter(delay time.Duration) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(delay)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	}
+}
+
+func TestFastestStrategy(t *testing.T) {
+	selector := NewDNSServerSelector([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"})
+	if err := selector.UseStrategy(&UpstreamConf{Strategy: StrategyFastest}); err != nil {
+		t.Fatal(err)
+	}
+	selector.ReportSuccess("10.0.0.1", 80*time.Millisecond)
+	selector.ReportSuccess("10.0.0.2", 20*time.Millisecond)
+	selector.ReportSuccess("10.0.0.3", 40*time.Millisecond)
+	for range 3 {
+		if got := selector.Pick("example.com.", nil); !slices.Equal(got, []string{"10.0.0.2"}) {
+			t.Errorf("DNSServerSelector.Pick() = %v, want fastest server", got)
+		}
+	}
+
+	// the average follows the server getting slower
+	for range 5 {
+		selector.ReportSuccess("10.0.0.2", 200*time.Millisecond)
+	}
+	if got := selector.Pick("example.com.", nil); !slices.Equal(got, []string{"10.0.0.3"}) {
+		t.Errorf("DNSServerSelector.Pick() = %v, want 10.0.0.3 after 10.0.0.2 slowed down", got)
+	}
+}
+
+func TestFastestStrategy_explore(t *testing.T) {
+	selector := NewDNSServerSelector([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"})
+	if err := selector.UseStrategy(&UpstreamConf{Strategy: StrategyFastest}); err != nil {
+		t.Fatal(err)
+	}
+	selector.ReportSuccess("10.0.0.1", 20*time.Millisecond)
+	selector.ReportSuccess("10.0.0.2", 200*time.Millisecond)
+	selector.ReportSuccess("10.0.0.3", 300*time.Millisecond)
+
+	// the slower servers are tried now and then, and answer fast again
+	picks := make(map[string]int)
+	for i := range 20 * exploreInterval {
+		server := selector.Pick("example.com.", nil)[0]
+		picks[server]++
+		if server == "10.0.0.1" {
+			selector.ReportSuccess(server, 20*time.Millisecond)
+		} else {
+			selector.ReportSuccess(server, 5*time.Millisecond)
+		}
+		if i == 2*exploreInterval-1 && (picks["10.0.0.2"] != 1 || picks["10.0.0.3"] != 1) {
+			t.Errorf("DNSServerSelector.Pick() distribution = %v, want each slower server tried once", picks)
+		}
+	}
+	if got := selector.Pick("example.com.", nil)[0]; got == "10.0.0.1" {
+		t.Errorf("DNSServerSelector.Pick() = %s, want a recovered server to win again", got)
+	}
+}
+
+func TestHashStrategy(t *testing.T) {
+	servers := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	selector := NewDNSServerSelector(servers)
+	if err := selector.UseStrategy(&UpstreamConf{Strategy: StrategyHash}); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"a.example.", "b.example.", "c.example.", "d.example.", "e.example.", "f.example."}
+	assigned := make(map[string]string)
+	for _, name := range names {
+		assigned[name] = selector.Pick(name, nil)[0]
+		for range 3 {
+			if got := selector.Pick(name, nil)[0]; got != assigned[name] {
+				t.Errorf("DNSServerSelector.Pick(%s) = %s, want %s every time", name, got, assigned[name])
+			}
+		}
+		if got := selector.Pick(dns.CanonicalName(name), nil)[0]; got != assigned[name] {
+			t.Errorf("DNSServerSelector.Pick() depends on case of %s", name)
+		}
+	}
+
+	// only names of the excluded server move
+	for _, name := range names {
+		got := selector.Pick(name, []string{"10.0.0.1"})[0]
+		if assigned[name] != "10.0.0.1" && got != assigned[name] {
+			t.Errorf("DNSServerSelector.Pick(%s) moved from %s to %s", name, assigned[name], got)
+		}
+	}
+}
+
+func TestWeightedStrategy(t *testing.T) {
+	selector := NewDNSServerSelector([]string{"10.0.0.1", "10.0.0.2"})
+	err := selector.UseStrategy(&UpstreamConf{
+		Strategy: StrategyWeighted,
+		Weights:  map[string]int{"10.0.0.1": 9},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	picks := make(map[string]int)
+	for range 1000 {
+		picks[selector.Pick("example.com.", nil)[0]]++
+	}
+	if picks["10.0.0.1"] < 800 || picks["10.0.0.2"] < 50 {
+		t.Errorf("DNSServerSelector.Pick() distribution = %v, want about 9:1", picks)
+	}
+}
+
+func TestParallelStrategy(t *testing.T) {
+	slow := startStandIn(t, answerAfter(time.Second))
+	fast := startStandIn(t, answerAfter(0))
+	selector := NewDNSServerSelector([]string{slow, fast})
+	if err := selector.UseStrategy(&UpstreamConf{Strategy: StrategyParallel}); err != nil {
+		t.Fatal(err)
+	}
+	dnsService := &DNSService{upstreams: upstream.NewPool(upstream.Options{})}
+	defer dnsService.Close()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	startTime := time.Now()
+	if _, err := dnsService.queryServers(context.Background(), msg, selector); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(startTime); elapsed > 500*time.Millisecond {
+		t.Errorf("DNSService.queryServers() took %v, want the fast answer", elapsed)
+	}
+	for _, status := range selector.Status() {
+		if status.Failures != 0 {
+			t.Errorf("DNSServerSelector.Status() = %+v, want losing server not counted as failed", status)
+		}
+	}
+}
+
+func TestUseStrategy(t *testing.T) {
+	selector := NewDNSServerSelector([]string{"10.0.0.1"})
+	if err := selector.UseStrategy(&UpstreamConf{Strategy: "random"}); err == nil {
+		t.Errorf("DNSServerSelector.UseStrategy() error = nil, want unknown strategy")
+	}
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"log/slog"
+	"maps"
+	"slices"
+
+	"github.com/quaintdev/webshield/src/internal/dto"
+	"github.com/quaintdev/webshield/src/internal/entity"
+)
+
+// newUpstreamGroups creates a selector for every upstream group of
+// config.json. Groups spread queries with the configured strategy.
+func newUpstreamGroups(groups map[string][]string, conf *UpstreamConf) map[string]*DNSServerSelector {
+	selectors := make(map[string]*DNSServerSelector, len(groups))
+	for name, servers := range groups {
+		if len(servers) == 0 {
+			slog.Error("ignoring upstream group without servers", "group", name)
+			continue
+		}
+		selector := NewDNSServerSelector(servers)
+		if err := selector.UseStrategy(conf); err != nil {
+			slog.Error("invalid upstream strategy for group", "group", name, "error", err)
+		}
+		selectors[name] = selector
+	}
+	return selectors
+}
+
+// route returns the servers answering name for the preset along with a
+// key naming them. Forwarding rules come first, then the upstream group of
+// the preset. The key is empty for the default servers.
+func (dnsService *DNSService) route(config *entity.Settings, name string) (string, *DNSServerSelector) {
+	if rule, selector := dnsService.forwarding.route(config, name); selector != nil {
+		return rule, selector
+	}
+	if config != nil && config.UpstreamGroup != "" {
+		if selector, ok := dnsService.upstreamGroups[config.UpstreamGroup]; ok {
+			return "group:" + config.UpstreamGroup, selector
+		}
+		slog.Warn("unknown upstream group, using default servers", "configId", config.ID, "group", config.UpstreamGroup)
+	}
+	return "", dnsService.upstreamServerSelector
+}
+
+// groupStatus returns the health of the servers of every upstream group
+func (dnsService *DNSService) groupStatus() []dto.UpstreamStatus {
+	var status []dto.UpstreamStatus
+	for name, selector := range dnsService.upstreamGroups {
+		for _, upstreamStatus := range selector.Status() {
+			upstreamStatus.Group = name
+			status = append(status, upstreamStatus)
+		}
+	}
+	return status
+}
+
+// forwardingStatus returns the health of the servers of every forwarding
+// rule, global rules first
+func (dnsService *DNSService) forwardingStatus() []dto.UpstreamStatus {
+	selectors := dnsService.forwarding.selectors()
+	rules := slices.Sorted(maps.Keys(selectors))
+	var status []dto.UpstreamStatus
+	for _, rule := range rules {
+		for _, upstreamStatus := range selectors[rule].Status() {
+			upstreamStatus.Forwarding = rule
+			status = append(status, upstreamStatus)
+		}
+	}
+	return status
+}
@@ -0,0 +1,45 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/quaintdev/webshield/src/internal/entity"
+)
+
+func TestDNSService_route(t *testing.T) {
+	dnsService := &DNSService{
+		upstreamServerSelector: NewDNSServerSelector([]string{"8.8.8.8"}),
+		forwarding: newForwardingRouter([]entity.ForwardingRule{
+			{Domain: "corp.example", Servers: []string{"10.0.0.53"}},
+		}),
+		upstreamGroups: newUpstreamGroups(map[string][]string{
+			"family": {"1.1.1.3"},
+			"empty":  {},
+		}, &UpstreamConf{}),
+	}
+
+	tests := []struct {
+		name       string
+		group      string
+		domain     string
+		wantRoute  string
+		wantServer string
+	}{
+		{name: "default servers", domain: "example.com.", wantRoute: "", wantServer: "8.8.8.8"},
+		{name: "group", group: "family", domain: "example.com.", wantRoute: "group:family", wantServer: "1.1.1.3"},
+		{name: "forwarding before group", group: "family", domain: "intranet.corp.example.", wantRoute: "corp.example", wantServer: "10.0.0.53"},
+		{name: "unknown group", group: "kids", domain: "example.com.", wantRoute: "", wantServer: "8.8.8.8"},
+		{name: "group without servers", group: "empty", domain: "example.com.", wantRoute: "", wantServer: "8.8.8.8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route, selector := dnsService.route(&entity.Settings{ID: "preset", UpstreamGroup: tt.group}, tt.domain)
+			if route != tt.wantRoute {
+				t.Errorf("DNSService.route() = %q, want %q", route, tt.wantRoute)
+			}
+			if got := selector.GetServers(); len(got) != 1 || got[0] != tt.wantServer {
+				t.Errorf("DNSService.route() servers = %v, want %s", got, tt.wantServer)
+			}
+		})
+	}
+}
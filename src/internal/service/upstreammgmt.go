@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/quaintdev/webshield/src/internal/apperrors"
+	"github.com/quaintdev/webshield/src/internal/dto"
+	"github.com/quaintdev/webshield/src/internal/repository"
+	"github.com/quaintdev/webshield/src/internal/upstream"
+)
+
+// UpstreamMgmtService changes the upstream servers at runtime. Changes are
+// persisted and take precedence over DNSServers of config.json.
+type UpstreamMgmtService struct {
+	dnsService   *DNSService
+	upstreamRepo repository.UpstreamRepository
+}
+
+func NewUpstreamMgmtService(dnsService *DNSService, upstreamRepo repository.UpstreamRepository) *UpstreamMgmtService {
+	return &UpstreamMgmtService{
+		dnsService:   dnsService,
+		upstreamRepo: upstreamRepo,
+	}
+}
+
+// LoadUpstreams replaces the servers of config.json with the persisted ones
+func (s *UpstreamMgmtService) LoadUpstreams(ctx context.Context) error {
+	upstreams, err := s.upstreamRepo.GetUpstreams(ctx)
+	if err != nil {
+		return err
+	}
+	if len(upstreams) == 0 {
+		return nil
+	}
+	slog.Info("using persisted upstream servers", "count", len(upstreams))
+	s.dnsService.upstreamServerSelector.SetUpstreams(upstreams)
+	return nil
+}
+
+// GetUpstreams returns the health of the default servers followed by the
+// servers of upstream groups and of forwarding rules
+func (s *UpstreamMgmtService) GetUpstreams() []dto.UpstreamStatus {
+	status := append(s.dnsService.upstreamServerSelector.Status(), s.dnsService.groupStatus()...)
+	return append(status, s.dnsService.forwardingStatus()...)
+}
+
+func (s *UpstreamMgmtService) AddUpstream(ctx context.Context, address string) error {
+	slog.Debug("adding upstream", "address", address)
+	u, err := upstream.New(address, upstream.Options{})
+	if err != nil {
+		return fmt.Errorf("%w: %v", apperrors.ErrInvalidInput, err)
+	}
+	u.Close()
+	err = s.dnsService.upstreamServerSelector.AddServer(address)
+	if err != nil {
+		return err
+	}
+	return s.persist(ctx)
+}
+
+func (s *UpstreamMgmtService) RemoveUpstream(ctx context.Context, address string) error {
+	slog.Debug("removing upstream", "address", address)
+	err := s.dnsService.upstreamServerSelector.RemoveServer(address)
+	if err != nil {
+		return err
+	}
+	s.dnsService.upstreams.Remove(address)
+	return s.persist(ctx)
+}
+
+func (s *UpstreamMgmtService) DrainUpstream(ctx context.Context, address string, drained bool) error {
+	slog.Debug("setting upstream drain state", "address", address, "drained", drained)
+	err := s.dnsService.upstreamServerSelector.DrainServer(address, drained)
+	if err != nil {
+		return err
+	}
+	return s.persist(ctx)
+}
+
+func (s *UpstreamMgmtService) ReorderUpstreams(ctx context.Context, addresses []string) error {
+	slog.Debug("reordering upstreams", "addresses", addresses)
+	err := s.dnsService.upstreamServerSelector.ReorderServers(addresses)
+	if err != nil {
+		return err
+	}
+	return s.persist(ctx)
+}
+
+func (s *UpstreamMgmtService) persist(ctx context.Context) error {
+	err := s.upstreamRepo.UpdateUpstreams(ctx, s.dnsService.upstreamServerSelector.GetUpstreams())
+	if err != nil {
+		slog.Error("failed to persist upstreams", "error", err)
+		return err
+	}
+	return nil
+}
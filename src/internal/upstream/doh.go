@@ -0,0 +1,89 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// dohUpstream queries a DNS over HTTPS server as per RFC 8484. The HTTP
+// client keeps connections alive between queries.
+type dohUpstream struct {
+	address string
+	url     string
+	client  *http.Client
+	timeout time.Duration
+}
+
+func newDoH(address string, u *url.URL, dialer *net.Dialer, opts Options) *dohUpstream {
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     clientTLSConfig(opts, u.Hostname()),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &dohUpstream{
+		address: address,
+		url:     u.String(),
+		client:  &http.Client{Transport: transport},
+		timeout: opts.Timeout,
+	}
+}
+
+func (u *dohUpstream) Address() string {
+	return u.address
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	// the id is zero for responses to be cacheable by HTTP caches
+	query := msg.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with status %d", u.address, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	response := new(dns.Msg)
+	if err := response.Unpack(body); err != nil {
+		return nil, err
+	}
+	response.Id = msg.Id
+	return response, nil
+}
+
+func (u *dohUpstream) Close() error {
+	u.client.CloseIdleConnections()
+	return nil
+}
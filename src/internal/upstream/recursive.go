@@ -0,0 +1,423 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Recursive is the address of the upstream resolving queries itself,
+// starting from the root servers
+const Recursive = "recursive"
+
+const (
+	// maxServerTimeout bounds the wait for a single authoritative server,
+	// other servers of the zone are tried next
+	maxServerTimeout = 2 * time.Second
+	// maxQueries bounds the queries sent to resolve one question, including
+	// the addresses of name servers and CNAME targets
+	maxQueries = 64
+	// maxCNAMEs bounds the CNAME records followed for one question
+	maxCNAMEs = 8
+	// maxNameServerDepth bounds nested lookups of name server addresses
+	maxNameServerDepth = 4
+	// maxMinimised bounds the queries hiding labels of a name, as of the
+	// MAX_MINIMISE_COUNT of RFC 9156
+	maxMinimised = 10
+	// maxDelegations bounds the delegations kept in the cache
+	maxDelegations = 10000
+	// maxDelegationTTL bounds how long a delegation is reused
+	maxDelegationTTL = 24 * time.Hour
+	// recursiveUDPSize is the EDNS buffer size sent to authoritative servers
+	recursiveUDPSize = 1232
+)
+
+// rootHints are the IPv4 addresses of the root servers a to m
+var rootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+// delegation holds the name servers of a zone
+type delegation struct {
+	zone string
+	// servers are addresses with port
+	servers []string
+	expires time.Time
+}
+
+// recursiveUpstream resolves queries by following referrals from the root
+// servers. Delegations are cached, answers are left to the caller to cache.
+type recursiveUpstream struct {
+	roots    []string
+	port     string
+	minimize bool
+	udp      *dns.Client
+	tcp      *dns.Client
+
+	mu          sync.Mutex
+	delegations map[string]*delegation
+}
+
+func newRecursive(opts Options) *recursiveUpstream {
+	hints := opts.RootHints
+	if len(hints) == 0 {
+		hints = rootHints
+	}
+	roots := make([]string, 0, len(hints))
+	for _, hint := range hints {
+		roots = append(roots, withDefaultPort(hint, "53"))
+	}
+	timeout := min(opts.Timeout, maxServerTimeout)
+	return &recursiveUpstream{
+		roots:       roots,
+		port:        "53",
+		minimize:    !opts.DisableQNAMEMinimization,
+		udp:         &dns.Client{Net: "udp", Timeout: timeout},
+		tcp:         &dns.Client{Net: "tcp", Timeout: timeout},
+		delegations: make(map[string]*delegation),
+	}
+}
+
+func (u *recursiveUpstream) Address() string {
+	return Recursive
+}
+
+func (u *recursiveUpstream) Close() error {
+	return nil
+}
+
+// resolution counts the queries sent for one question
+type resolution struct {
+	queries int
+}
+
+// Exchange resolves the question of msg. Names that cannot be resolved are
+// answered with SERVFAIL like a forwarder would.
+func (u *recursiveUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	reply := new(dns.Msg)
+	if len(msg.Question) != 1 {
+		reply.SetRcode(msg, dns.RcodeFormatError)
+		return reply, nil
+	}
+	question := msg.Question[0]
+	do := msg.IsEdns0() != nil && msg.IsEdns0().Do()
+
+	response, err := u.resolve(ctx, &resolution{}, question.Name, question.Qtype, do, 0)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		slog.Debug("recursive resolution failed", "domain", question.Name, "error", err)
+		reply.SetRcode(msg, dns.RcodeServerFailure)
+		reply.RecursionAvailable = true
+		return reply, nil
+	}
+
+	reply.SetRcode(msg, response.Rcode)
+	reply.RecursionAvailable = true
+	reply.Answer = response.Answer
+	reply.Ns = response.Ns
+	for _, rr := range response.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			reply.Extra = append(reply.Extra, rr)
+		}
+	}
+	if msg.IsEdns0() != nil {
+		reply.SetEdns0(recursiveUDPSize, do)
+	}
+	return reply, nil
+}
+
+// resolve looks up name and follows CNAME records to the records of qtype
+func (u *recursiveUpstream) resolve(ctx context.Context, r *resolution, name string, qtype uint16, do bool, depth int) (*dns.Msg, error) {
+	var chain []dns.RR
+	for range maxCNAMEs {
+		response, err := u.lookup(ctx, r, name, qtype, do, depth)
+		if err != nil {
+			return nil, err
+		}
+		response.Answer = append(chain, response.Answer...)
+		target := cnameTarget(response.Answer, name, qtype)
+		if target == "" || response.Rcode != dns.RcodeSuccess {
+			return response, nil
+		}
+		chain = response.Answer
+		name = target
+	}
+	return nil, fmt.Errorf("CNAME chain of %s is too long", name)
+}
+
+// lookup follows referrals from the closest known delegation to the servers
+// answering for name. Unless disabled, servers above the zone of name only
+// learn the next label of name as of RFC 9156.
+func (u *recursiveUpstream) lookup(ctx context.Context, r *resolution, name string, qtype uint16, do bool, depth int) (*dns.Msg, error) {
+	name = dns.CanonicalName(name)
+	d := u.closest(name, qtype)
+	// known is the longest ancestor of name the servers of d were asked for
+	known := d.zone
+	minimised := 0
+	for {
+		qname, qtypeSent := name, qtype
+		if u.minimize && minimised < maxMinimised && dns.CountLabel(name)-dns.CountLabel(known) > 1 {
+			qname, qtypeSent = ancestor(name, dns.CountLabel(known)+1), dns.TypeA
+			minimised++
+		}
+		response, err := u.query(ctx, r, d, qname, qtypeSent, do)
+		if err != nil {
+			u.forget(d.zone)
+			return nil, err
+		}
+
+		if child := referral(response, d.zone, name, qtype); child != "" {
+			d, err = u.delegate(ctx, r, d.zone, child, response, depth)
+			if err != nil {
+				return nil, err
+			}
+			known = d.zone
+			continue
+		}
+		if qname == name {
+			return response, nil
+		}
+		if response.Rcode == dns.RcodeNameError {
+			// nothing exists below a name that does not exist, RFC 8020
+			return response, nil
+		}
+		// qname is inside the zone of d, ask for the next label
+		known = qname
+	}
+}
+
+// query sends a question to the servers of d until one answers
+func (u *recursiveUpstream) query(ctx context.Context, r *resolution, d *delegation, qname string, qtype uint16, do bool) (*dns.Msg, error) {
+	lastErr := errors.New("no servers")
+	for _, server := range d.servers {
+		r.queries++
+		if r.queries > maxQueries {
+			return nil, errors.New("too many queries")
+		}
+		msg := new(dns.Msg)
+		msg.SetQuestion(qname, qtype)
+		msg.RecursionDesired = false
+		msg.SetEdns0(recursiveUDPSize, do)
+		response, err := u.exchange(ctx, msg, server)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s answered %s", server, dns.RcodeToString[response.Rcode])
+			continue
+		}
+		return response, nil
+	}
+	return nil, fmt.Errorf("no server of %s answered: %w", d.zone, lastErr)
+}
+
+// exchange sends msg to server over UDP and falls back to TCP when the
+// response is truncated
+func (u *recursiveUpstream) exchange(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, error) {
+	response, _, err := u.udp.ExchangeContext(ctx, msg, server)
+	if err == nil && response.Truncated {
+		response, _, err = u.tcp.ExchangeContext(ctx, msg, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Question) != 1 || !strings.EqualFold(response.Question[0].Name, msg.Question[0].Name) {
+		return nil, fmt.Errorf("%s answered another question", server)
+	}
+	return response, nil
+}
+
+// delegate returns the delegation to child found in response, resolving
+// the addresses of the name servers when the parent gave none
+func (u *recursiveUpstream) delegate(ctx context.Context, r *resolution, parent string, child string, response *dns.Msg, depth int) (*delegation, error) {
+	var hosts []string
+	ttl := maxDelegationTTL
+	for _, rr := range response.Ns {
+		if ns, ok := rr.(*dns.NS); ok && dns.CanonicalName(ns.Hdr.Name) == child {
+			hosts = append(hosts, dns.CanonicalName(ns.Ns))
+			ttl = min(ttl, time.Duration(ns.Hdr.Ttl)*time.Second)
+		}
+	}
+
+	// addresses of hosts outside the zone of the parent are not trusted
+	var servers []string
+	for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		for _, rr := range response.Extra {
+			name := dns.CanonicalName(rr.Header().Name)
+			if rr.Header().Rrtype != rrtype || !dns.IsSubDomain(parent, name) || !slices.Contains(hosts, name) {
+				continue
+			}
+			switch rr := rr.(type) {
+			case *dns.A:
+				servers = append(servers, net.JoinHostPort(rr.A.String(), u.port))
+			case *dns.AAAA:
+				servers = append(servers, net.JoinHostPort(rr.AAAA.String(), u.port))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		if depth >= maxNameServerDepth {
+			return nil, fmt.Errorf("name servers of %s are nested too deep", child)
+		}
+		for _, host := range hosts {
+			servers = u.addresses(ctx, r, host, depth+1)
+			if len(servers) > 0 {
+				break
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no address of the name servers of %s", child)
+	}
+
+	d := &delegation{zone: child, servers: servers, expires: time.Now().Add(ttl)}
+	u.store(d)
+	return d, nil
+}
+
+// addresses resolves the IPv4 addresses of a name server
+func (u *recursiveUpstream) addresses(ctx context.Context, r *resolution, host string, depth int) []string {
+	response, err := u.resolve(ctx, r, host, dns.TypeA, false, depth)
+	if err != nil {
+		slog.Debug("could not resolve name server", "host", host, "error", err)
+		return nil
+	}
+	var servers []string
+	for _, rr := range response.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			servers = append(servers, net.JoinHostPort(a.A.String(), u.port))
+		}
+	}
+	return servers
+}
+
+// closest returns the cached delegation closest to name, the root servers
+// when none is cached. DS records are asked from the parent zone.
+func (u *recursiveUpstream) closest(name string, qtype uint16) *delegation {
+	start := name
+	if qtype == dns.TypeDS && name != "." {
+		start = ancestor(name, dns.CountLabel(name)-1)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	for labels := dns.CountLabel(start); labels > 0; labels-- {
+		if d, ok := u.delegations[ancestor(start, labels)]; ok && now.Before(d.expires) {
+			return d
+		}
+	}
+	return &delegation{zone: ".", servers: u.roots}
+}
+
+func (u *recursiveUpstream) store(d *delegation) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.delegations) >= maxDelegations {
+		now := time.Now()
+		for zone, cached := range u.delegations {
+			if !now.Before(cached.expires) {
+				delete(u.delegations, zone)
+			}
+		}
+		// still full, make room for d at random
+		for zone := range u.delegations {
+			if len(u.delegations) < maxDelegations {
+				break
+			}
+			delete(u.delegations, zone)
+		}
+	}
+	u.delegations[d.zone] = d
+}
+
+// forget drops the delegation of a zone whose servers did not answer, so
+// that the parent is asked again
+func (u *recursiveUpstream) forget(zone string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.delegations, zone)
+}
+
+// referral returns the zone response delegates to, empty when response is
+// no referral. Only delegations below zone and above name are followed.
+func referral(response *dns.Msg, zone string, name string, qtype uint16) string {
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) > 0 {
+		return ""
+	}
+	for _, rr := range response.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		child := dns.CanonicalName(ns.Hdr.Name)
+		if child == zone || !dns.IsSubDomain(zone, child) || !dns.IsSubDomain(child, name) {
+			continue
+		}
+		if qtype == dns.TypeDS && child == name {
+			// DS records are held by the parent of name
+			continue
+		}
+		return child
+	}
+	return ""
+}
+
+// cnameTarget returns the name the CNAME records of answer lead to from
+// name, empty when answer holds the records of qtype or no CNAME
+func cnameTarget(answer []dns.RR, name string, qtype uint16) string {
+	if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return ""
+	}
+	name = dns.CanonicalName(name)
+	target := name
+	for range answer {
+		next := ""
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cname.Hdr.Name) == target {
+				next = dns.CanonicalName(cname.Target)
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	if target == name {
+		return ""
+	}
+	for _, rr := range answer {
+		if dns.CanonicalName(rr.Header().Name) == target && rr.Header().Rrtype == qtype {
+			return ""
+		}
+	}
+	return target
+}
+
+// ancestor returns the last labels of name
+func ancestor(name string, labels int) string {
+	split := dns.SplitDomainName(name)
+	if labels <= 0 {
+		return "."
+	}
+	if labels >= len(split) {
+		return dns.Fqdn(name)
+	}
+	return dns.Fqdn(strings.Join(split[len(split)-labels:], "."))
+}
@@ -0,0 +1,269 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// authority is a stand-in authoritative server for zone. NS records below
+// the zone are delegations and answered with referrals.
+type authority struct {
+	zone    string
+	records []dns.RR
+
+	mu      sync.Mutex
+	queries []dns.Question
+}
+
+func newAuthority(t *testing.T, zone string, records ...string) *authority {
+	t.Helper()
+	a := &authority{zone: zone}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.records = append(a.records, rr)
+	}
+	return a
+}
+
+func (a *authority) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	a.mu.Lock()
+	a.queries = append(a.queries, r.Question[0])
+	a.mu.Unlock()
+
+	q := r.Question[0]
+	name := dns.CanonicalName(q.Name)
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	// referral to the closest delegation above name
+	for _, rr := range a.records {
+		cut := rr.Header().Name
+		if rr.Header().Rrtype != dns.TypeNS || cut == a.zone || !dns.IsSubDomain(cut, name) {
+			continue
+		}
+		if q.Qtype == dns.TypeDS && cut == name {
+			break
+		}
+		for _, rr := range a.records {
+			if rr.Header().Name == cut && rr.Header().Rrtype == dns.TypeNS {
+				m.Ns = append(m.Ns, rr)
+				for _, glue := range a.records {
+					if glue.Header().Name == rr.(*dns.NS).Ns && glue.Header().Rrtype == dns.TypeA {
+						m.Extra = append(m.Extra, glue)
+					}
+				}
+			}
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	m.Authoritative = true
+	exists := false
+	for _, rr := range a.records {
+		if !dns.IsSubDomain(name, rr.Header().Name) {
+			continue
+		}
+		exists = true
+		if rr.Header().Name == name && (rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME) {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if !exists {
+		m.Rcode = dns.RcodeNameError
+	}
+	w.WriteMsg(m)
+}
+
+// names returns the names the authority was asked for
+func (a *authority) names() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var names []string
+	for _, q := range a.queries {
+		names = append(names, q.Name)
+	}
+	return names
+}
+
+// startHierarchy serves each authority on its own loopback address, all on
+// the same port. The address of the first one is returned.
+func startHierarchy(t *testing.T, authorities ...*authority) (string, string) {
+	t.Helper()
+	for range 10 {
+		conns := []net.PacketConn{}
+		var port string
+		for i := range authorities {
+			address := net.JoinHostPort("127.0.0."+strconv.Itoa(i+1), "0")
+			if port != "" {
+				address = net.JoinHostPort("127.0.0."+strconv.Itoa(i+1), port)
+			}
+			conn, err := net.ListenPacket("udp", address)
+			if err != nil {
+				break
+			}
+			_, port, _ = net.SplitHostPort(conn.LocalAddr().String())
+			conns = append(conns, conn)
+		}
+		if len(conns) < len(authorities) {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			continue
+		}
+		for i, conn := range conns {
+			started := make(chan struct{})
+			server := &dns.Server{PacketConn: conn, Handler: authorities[i], NotifyStartedFunc: func() { close(started) }}
+			go server.ActivateAndServe()
+			<-started
+			t.Cleanup(func() { server.Shutdown() })
+		}
+		return conns[0].LocalAddr().String(), port
+	}
+	t.Fatal("could not listen on loopback addresses")
+	return "", ""
+}
+
+// newTestHierarchy delegates test. with glue and sub.test. to a name server
+// in other. without glue
+func newTestHierarchy(t *testing.T) (root, test, other, sub *authority) {
+	root = newAuthority(t, ".",
+		"test. 3600 IN NS ns.test.",
+		"ns.test. 3600 IN A 127.0.0.2",
+		"test. 3600 IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF",
+		"other. 3600 IN NS ns.other.",
+		"ns.other. 3600 IN A 127.0.0.3",
+	)
+	test = newAuthority(t, "test.",
+		"test. 3600 IN NS ns.test.",
+		"www.test. 300 IN A 192.0.2.1",
+		"alias.test. 300 IN CNAME www.sub.test.",
+		"sub.test. 3600 IN NS ns.sub.other.",
+	)
+	other = newAuthority(t, "other.",
+		"other. 3600 IN NS ns.other.",
+		"ns.sub.other. 3600 IN A 127.0.0.4",
+	)
+	sub = newAuthority(t, "sub.test.",
+		"sub.test. 3600 IN NS ns.sub.other.",
+		"www.sub.test. 300 IN A 192.0.2.2",
+		"deep.er.sub.test. 300 IN A 192.0.2.3",
+	)
+	return root, test, other, sub
+}
+
+func TestRecursive_Exchange(t *testing.T) {
+	root, test, other, sub := newTestHierarchy(t)
+	address, port := startHierarchy(t, root, test, other, sub)
+	u := newRecursive(Options{RootHints: []string{address}, Timeout: defaultTimeout})
+	u.port = port
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		response, err := u.Exchange(context.Background(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Id != msg.Id || !response.RecursionAvailable {
+			t.Errorf("Exchange() = %v, want reply to the query with recursion available", response)
+		}
+		return response
+	}
+	address4 := func(response *dns.Msg) string {
+		t.Helper()
+		for _, rr := range response.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				return a.A.String()
+			}
+		}
+		t.Fatalf("Exchange() = %v, want A record", response)
+		return ""
+	}
+
+	if got := address4(resolve("www.test.", dns.TypeA)); got != "192.0.2.1" {
+		t.Errorf("Exchange() = %s, want 192.0.2.1", got)
+	}
+	// the name server of sub.test. has no glue and is resolved first
+	if got := address4(resolve("www.sub.test.", dns.TypeA)); got != "192.0.2.2" {
+		t.Errorf("Exchange() = %s, want 192.0.2.2", got)
+	}
+	response := resolve("alias.test.", dns.TypeA)
+	if len(response.Answer) != 2 || response.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("Exchange() = %v, want CNAME followed by its target", response)
+	}
+	if got := address4(resolve("deep.er.sub.test.", dns.TypeA)); got != "192.0.2.3" {
+		t.Errorf("Exchange() = %s, want 192.0.2.3", got)
+	}
+	if response := resolve("missing.test.", dns.TypeA); response.Rcode != dns.RcodeNameError {
+		t.Errorf("Exchange() = %v, want NXDOMAIN", response)
+	}
+	if response := resolve("test.", dns.TypeDS); len(response.Answer) != 1 {
+		t.Errorf("Exchange() = %v, want DS record from the root", response)
+	}
+
+	// servers above a zone only see the next label of a name
+	for _, name := range root.names() {
+		if dns.CountLabel(name) > 1 && name != "test." {
+			t.Errorf("root was asked for %s, want minimised names", name)
+		}
+	}
+	for _, name := range test.names() {
+		if dns.CountLabel(name) > 2 {
+			t.Errorf("test. was asked for %s, want minimised names", name)
+		}
+	}
+
+	// delegations are cached
+	asked := len(root.names())
+	resolve("www.test.", dns.TypeAAAA)
+	resolve("www.sub.test.", dns.TypeAAAA)
+	if got := len(root.names()); got != asked {
+		t.Errorf("root was asked %d more times, want delegations cached", got-asked)
+	}
+}
+
+func TestRecursive_withoutMinimization(t *testing.T) {
+	root, test, other, sub := newTestHierarchy(t)
+	address, port := startHierarchy(t, root, test, other, sub)
+	u := newRecursive(Options{RootHints: []string{address}, Timeout: defaultTimeout, DisableQNAMEMinimization: true})
+	u.port = port
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.sub.test.", dns.TypeA)
+	if _, err := u.Exchange(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if names := root.names(); len(names) == 0 || names[0] != "www.sub.test." {
+		t.Errorf("root was asked for %v, want full name", names)
+	}
+}
+
+func TestRecursive_unreachable(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := conn.LocalAddr().String()
+	conn.Close()
+	u := newRecursive(Options{RootHints: []string{address}, Timeout: defaultTimeout})
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.test.", dns.TypeA)
+	response, err := u.Exchange(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Exchange() = %v, want SERVFAIL", response)
+	}
+}
@@ -0,0 +1,178 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// streamUpstream queries a server over TCP or TLS. Connections are kept
+// open and reused by later queries.
+type streamUpstream struct {
+	address   string
+	addr      string
+	dialer    *net.Dialer
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	mu     sync.Mutex
+	idle   []*dns.Conn
+	closed bool
+}
+
+func newStream(address string, addr string, dialer *net.Dialer, tlsConfig *tls.Config, opts Options) *streamUpstream {
+	return &streamUpstream{
+		address:   address,
+		addr:      addr,
+		dialer:    dialer,
+		tlsConfig: tlsConfig,
+		timeout:   opts.Timeout,
+	}
+}
+
+func (u *streamUpstream) Address() string {
+	return u.address
+}
+
+func (u *streamUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	conn, reused := u.get()
+	if conn == nil {
+		var err error
+		conn, err = u.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	response, err := exchangeConn(ctx, conn, msg)
+	if err != nil && reused {
+		// the server may have closed the idle connection, retry on a new one
+		conn.Close()
+		conn, err = u.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		response, err = exchangeConn(ctx, conn, msg)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	u.put(conn)
+	return response, nil
+}
+
+func (u *streamUpstream) dial(ctx context.Context) (*dns.Conn, error) {
+	var conn net.Conn
+	var err error
+	if u.tlsConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: u.dialer, Config: u.tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", u.addr)
+	} else {
+		conn, err = u.dialer.DialContext(ctx, "tcp", u.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %v", u.address, err)
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// get returns an idle connection, nil when there is none
+func (u *streamUpstream) get() (*dns.Conn, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.idle) == 0 {
+		return nil, false
+	}
+	conn := u.idle[len(u.idle)-1]
+	u.idle = u.idle[:len(u.idle)-1]
+	return conn, true
+}
+
+// put keeps conn for reuse unless enough connections are idle
+func (u *streamUpstream) put(conn *dns.Conn) {
+	conn.SetDeadline(time.Time{})
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed || len(u.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	u.idle = append(u.idle, conn)
+}
+
+func (u *streamUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	for _, conn := range u.idle {
+		conn.Close()
+	}
+	u.idle = nil
+	return nil
+}
+
+// exchangeConn sends msg over conn and reads the response
+func exchangeConn(ctx context.Context, conn *dns.Conn, msg *dns.Msg) (*dns.Msg, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := conn.WriteMsg(msg); err != nil {
+		return nil, err
+	}
+	response, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if response.Id != msg.Id {
+		return nil, errors.New("response id does not match query")
+	}
+	return response, nil
+}
+
+// plainUpstream queries a server over UDP and falls back to TCP when the
+// response is truncated
+type plainUpstream struct {
+	address string
+	addr    string
+	client  *dns.Client
+	tcp     *streamUpstream
+}
+
+func newPlain(address string, addr string, dialer *net.Dialer, opts Options) *plainUpstream {
+	return &plainUpstream{
+		address: address,
+		addr:    addr,
+		client:  &dns.Client{Net: "udp", Timeout: opts.Timeout, Dialer: dialer},
+		tcp:     newStream(address, addr, dialer, nil, opts),
+	}
+}
+
+func (u *plainUpstream) Address() string {
+	return u.address
+}
+
+func (u *plainUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	response, _, err := u.client.ExchangeContext(ctx, msg, u.addr)
+	if err != nil {
+		// a server that does not answer over UDP is unlikely to answer
+		// over TCP, leave the retry to another server
+		return nil, err
+	}
+	if response.Truncated {
+		return u.tcp.Exchange(ctx, msg)
+	}
+	return response, nil
+}
+
+func (u *plainUpstream) Close() error {
+	return u.tcp.Close()
+}
@@ -0,0 +1,172 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultTimeout bounds a single exchange unless Options say otherwise
+	defaultTimeout = 5 * time.Second
+	// maxIdleConns is the number of idle connections kept per upstream
+	maxIdleConns = 8
+)
+
+// Upstream is a DNS server queries are forwarded to
+type Upstream interface {
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+	// Address returns the address the upstream was configured with
+	Address() string
+	Close() error
+}
+
+type Options struct {
+	// Timeout bounds a single exchange
+	Timeout time.Duration
+	// Bootstrap are plain DNS servers resolving the hostnames of upstreams.
+	// The system resolver is used when empty.
+	Bootstrap []string
+	// TLSConfig is the base configuration of DoT and DoH connections
+	TLSConfig *tls.Config
+	// RootHints are the root servers the recursive upstream starts from,
+	// the IANA root servers when empty
+	RootHints []string
+	// DisableQNAMEMinimization makes the recursive upstream send full names
+	// to every server
+	DisableQNAMEMinimization bool
+}
+
+// New creates the upstream for an address such as "1.1.1.1",
+// "udp://1.1.1.1", "tcp://1.1.1.1:53", "tls://dns.quad9.net" or
+// "https://cloudflare-dns.com/dns-query". Addresses without a scheme are
+// queried over UDP with a fallback to TCP. The address "recursive" resolves
+// queries from the root servers without forwarding them.
+func New(address string, opts Options) (Upstream, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if address == Recursive {
+		return newRecursive(opts), nil
+	}
+	dialer := newDialer(opts)
+	if !strings.Contains(address, "://") {
+		return newPlain(address, withDefaultPort(address, "53"), dialer, opts), nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %s: %v", address, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid upstream %s: missing host", address)
+	}
+	switch u.Scheme {
+	case "udp":
+		return newPlain(address, withDefaultPort(u.Host, "53"), dialer, opts), nil
+	case "tcp":
+		return newStream(address, withDefaultPort(u.Host, "53"), dialer, nil, opts), nil
+	case "tls":
+		return newStream(address, withDefaultPort(u.Host, "853"), dialer, clientTLSConfig(opts, u.Hostname()), opts), nil
+	case "https":
+		return newDoH(address, u, dialer, opts), nil
+	}
+	return nil, fmt.Errorf("unsupported upstream scheme %q in %s", u.Scheme, address)
+}
+
+// newDialer returns a dialer resolving hostnames through the bootstrap
+// servers
+func newDialer(opts Options) *net.Dialer {
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	if len(opts.Bootstrap) == 0 {
+		return dialer
+	}
+	var next atomic.Uint32
+	dialer.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			server := opts.Bootstrap[next.Add(1)%uint32(len(opts.Bootstrap))]
+			d := net.Dialer{Timeout: opts.Timeout}
+			return d.DialContext(ctx, network, withDefaultPort(server, "53"))
+		},
+	}
+	return dialer
+}
+
+func clientTLSConfig(opts Options, serverName string) *tls.Config {
+	config := &tls.Config{}
+	if opts.TLSConfig != nil {
+		config = opts.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = serverName
+	}
+	config.MinVersion = max(config.MinVersion, tls.VersionTLS12)
+	return config
+}
+
+// withDefaultPort adds port to addresses configured without one
+func withDefaultPort(address string, port string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), port)
+}
+
+// Pool creates upstreams on first use and keeps them so that their
+// connections are reused across queries
+type Pool struct {
+	opts      Options
+	mu        sync.Mutex
+	upstreams map[string]Upstream
+}
+
+func NewPool(opts Options) *Pool {
+	return &Pool{
+		opts:      opts,
+		upstreams: make(map[string]Upstream),
+	}
+}
+
+// Get returns the upstream for address
+func (p *Pool) Get(address string) (Upstream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if u, ok := p.upstreams[address]; ok {
+		return u, nil
+	}
+	u, err := New(address, p.opts)
+	if err != nil {
+		return nil, err
+	}
+	p.upstreams[address] = u
+	return u, nil
+}
+
+// Close closes the connections of every upstream
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for address, u := range p.upstreams {
+		u.Close()
+		delete(p.upstreams, address)
+	}
+}
+
+// Remove closes the upstream for address
+func (p *Pool) Remove(address string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if u, ok := p.upstreams[address]; ok {
+		u.Close()
+		delete(p.upstreams, address)
+	}
+}
@@ -0,0 +1,228 @@
+package upstream
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// answer replies to A queries with 192.0.2.1 and to other queries with no data.
+// dns.test resolves to the loopback address for bootstrap tests.
+func answer(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	q := r.Question[0]
+	if q.Qtype != dns.TypeA {
+		return m
+	}
+	ip := net.IPv4(192, 0, 2, 1)
+	if q.Name == "dns.test." {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   ip,
+	})
+	return m
+}
+
+var handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+	w.WriteMsg(answer(r))
+})
+
+// countingListener counts accepted connections
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func startServer(t *testing.T, server *dns.Server) {
+	t.Helper()
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	server.Handler = handler
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+}
+
+func startUDP(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	startServer(t, &dns.Server{PacketConn: conn})
+	return conn.LocalAddr().String()
+}
+
+func startTLS(t *testing.T, config *tls.Config) (string, *countingListener) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &countingListener{Listener: l}
+	startServer(t, &dns.Server{Listener: listener, Net: "tcp-tls"})
+	return l.Addr().String(), listener
+}
+
+// testCertificate creates a self-signed certificate for dns.test and 127.0.0.1
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func query(t *testing.T, u Upstream, name string) {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	response, err := u.Exchange(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("%s: Exchange() error = %v", u.Address(), err)
+	}
+	if response.Id != msg.Id || len(response.Answer) != 1 {
+		t.Fatalf("%s: Exchange() = %v, want answer to query %d", u.Address(), response, msg.Id)
+	}
+	if a := response.Answer[0].(*dns.A); !a.A.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("%s: Exchange() answer = %v, want 192.0.2.1", u.Address(), a)
+	}
+}
+
+func TestPlainUpstream(t *testing.T) {
+	addr := startUDP(t)
+	for _, address := range []string{addr, "udp://" + addr} {
+		u, err := New(address, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		query(t, u, "example.com.")
+		u.Close()
+	}
+}
+
+func TestTLSUpstream(t *testing.T) {
+	cert, pool := testCertificate(t)
+	addr, listener := startTLS(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	_, port, _ := net.SplitHostPort(addr)
+
+	// dns.test is resolved through the bootstrap server
+	u, err := New("tls://dns.test:"+port, Options{
+		Bootstrap: []string{startUDP(t)},
+		TLSConfig: &tls.Config{RootCAs: pool},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	for range 3 {
+		query(t, u, "example.com.")
+	}
+	if got := listener.accepted.Load(); got != 1 {
+		t.Errorf("TLS upstream opened %d connections, want 1", got)
+	}
+}
+
+func TestDoHUpstream(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		msg := new(dns.Msg)
+		if err := msg.Unpack(body); err != nil || msg.Id != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		packed, _ := answer(msg).Pack()
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(packed)
+	}))
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	u, err := New(server.URL+"/dns-query", Options{TLSConfig: &tls.Config{RootCAs: pool}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	query(t, u, "example.com.")
+	query(t, u, "example.org.")
+	if got := requests.Load(); got != 2 {
+		t.Errorf("DoH server received %d requests, want 2", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, address := range []string{"quic://dns.adguard.com", "tls://", "https://:443/dns-query"} {
+		if _, err := New(address, Options{}); err == nil {
+			t.Errorf("New(%q) error = nil, want error", address)
+		}
+	}
+}
+
+func TestWithDefaultPort(t *testing.T) {
+	tests := map[string]string{
+		"1.1.1.1":         "1.1.1.1:53",
+		"10.0.0.53:5353":  "10.0.0.53:5353",
+		"2606:4700::1111": "[2606:4700::1111]:53",
+		"[fd00::53]:5353": "[fd00::53]:5353",
+	}
+	for address, want := range tests {
+		if got := withDefaultPort(address, "53"); got != want {
+			t.Errorf("withDefaultPort(%q) = %q, want %q", address, got, want)
+		}
+	}
+}
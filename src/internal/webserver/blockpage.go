@@ -0,0 +1,339 @@
+package webserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quaintdev/webshield/src/internal/service"
+)
+
+// leafCertValidity is how long minted block page certificates are valid
+const leafCertValidity = 7 * 24 * time.Hour
+
+// maxCachedCerts bounds the number of minted certificates kept for reuse
+const maxCachedCerts = 1024
+
+// BlockPageServer answers HTTP(S) requests for domains that were blocked
+// with a custom ip pointing at this server
+type BlockPageServer struct {
+	dnsService  blockService
+	conf        *service.BlockPageConf
+	httpServer  *http.Server
+	httpsServer *http.Server
+
+	ca      *x509.Certificate
+	caKey   crypto.Signer
+	leafKey *ecdsa.PrivateKey
+	certsMu sync.Mutex
+	certs   map[string]*tls.Certificate
+}
+
+// blockService explains and lifts the blocks served by the block page,
+// *service.DNSService outside of tests
+type blockService interface {
+	LookupBlock(client netip.Addr, domain string) (service.BlockEvent, bool)
+	IssueBlockToken(client netip.Addr, domain string) (string, bool)
+	ConfirmBlock(client netip.Addr, domain string, token string) (service.BlockEvent, bool)
+	AllowSoftBlocked(ctx context.Context, event service.BlockEvent) error
+}
+
+func NewBlockPageServer(dnsService blockService, conf *service.BlockPageConf) *BlockPageServer {
+	return &BlockPageServer{
+		dnsService: dnsService,
+		conf:       conf,
+		certs:      make(map[string]*tls.Certificate),
+	}
+}
+
+func (s *BlockPageServer) Start(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /continue", handleInterstitialContinue(s.dnsService))
+	mux.HandleFunc("/", handleBlockPage(s.dnsService))
+
+	var serversWg sync.WaitGroup
+	if s.conf.HTTPAddr != "" {
+		s.httpServer = &http.Server{Addr: s.conf.HTTPAddr, Handler: mux}
+		serversWg.Add(1)
+		go func() {
+			defer serversWg.Done()
+			slog.Info("block page server started", "addr", s.conf.HTTPAddr)
+			if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("error starting block page server", "error", err)
+			}
+		}()
+	}
+
+	if s.conf.HTTPSAddr != "" {
+		if err := s.loadCA(); err != nil {
+			slog.Error("failed to load block page CA", "error", err)
+		} else {
+			s.httpsServer = &http.Server{
+				Addr:      s.conf.HTTPSAddr,
+				Handler:   mux,
+				TLSConfig: &tls.Config{GetCertificate: s.getCertificate},
+			}
+			serversWg.Add(1)
+			go func() {
+				defer serversWg.Done()
+				slog.Info("block page TLS server started", "addr", s.conf.HTTPSAddr)
+				if err := s.httpsServer.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					slog.Error("error starting block page TLS server", "error", err)
+				}
+			}()
+		}
+	}
+	serversWg.Wait()
+}
+
+func (s *BlockPageServer) Shutdown(ctx context.Context) {
+	for _, server := range []*http.Server{s.httpServer, s.httpsServer} {
+		if server == nil {
+			continue
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("error shutting down block page server", "error", err)
+		}
+	}
+}
+
+func (s *BlockPageServer) loadCA() error {
+	if s.conf.CACertPath == "" || s.conf.CAKeyPath == "" {
+		return errors.New("CACertPath and CAKeyPath are required for HTTPS")
+	}
+	keyPair, err := tls.LoadX509KeyPair(s.conf.CACertPath, s.conf.CAKeyPath)
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	caKey, ok := keyPair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("unsupported CA key type")
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	s.ca, s.caKey, s.leafKey = ca, caKey, leafKey
+	return nil
+}
+
+// getCertificate mints a certificate for the requested server name signed
+// by the configured CA. Only names blocked recently get one, so that the CA
+// does not sign whatever name clients ask for. Certificates are reused until
+// they are about to expire.
+func (s *BlockPageServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serverName := strings.ToLower(hello.ServerName)
+	if serverName == "" {
+		return nil, errors.New("missing server name")
+	}
+	var client netip.Addr
+	if hello.Conn != nil {
+		client = service.ParseClientAddr(hello.Conn.RemoteAddr().String())
+	}
+	if _, ok := s.dnsService.LookupBlock(client, serverName); !ok {
+		return nil, fmt.Errorf("no recent block of %s", serverName)
+	}
+
+	s.certsMu.Lock()
+	defer s.certsMu.Unlock()
+	if cert, ok := s.certs[serverName]; ok && time.Until(cert.Leaf.NotAfter) > time.Hour {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: serverName},
+		DNSNames:     []string{serverName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, &s.leafKey.PublicKey, s.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not mint certificate for %s: %v", serverName, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, s.ca.Raw},
+		PrivateKey:  s.leafKey,
+		Leaf:        leaf,
+	}
+	s.storeCertificate(serverName, cert)
+	return cert, nil
+}
+
+// storeCertificate caches cert, dropping expiring certificates and then the
+// oldest ones once the cache is full. certsMu must be held.
+func (s *BlockPageServer) storeCertificate(serverName string, cert *tls.Certificate) {
+	if len(s.certs) >= maxCachedCerts {
+		var oldest string
+		for name, cached := range s.certs {
+			if time.Until(cached.Leaf.NotAfter) <= time.Hour {
+				delete(s.certs, name)
+			} else if oldest == "" || cached.Leaf.NotAfter.Before(s.certs[oldest].Leaf.NotAfter) {
+				oldest = name
+			}
+		}
+		if len(s.certs) >= maxCachedCerts {
+			delete(s.certs, oldest)
+		}
+	}
+	s.certs[serverName] = cert
+}
+
+func handleBlockPage(dnsService blockService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain := r.Host
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			domain = host
+		}
+		client := service.ParseClientAddr(r.RemoteAddr)
+		event, ok := dnsService.LookupBlock(client, domain)
+		if !ok {
+			event = service.BlockEvent{Domain: domain}
+		}
+		if event.SoftBlock {
+			// the token ties the confirmation to this page and client
+			token, _ := dnsService.IssueBlockToken(client, domain)
+			renderInterstitial(w, r, event, token, false)
+			return
+		}
+
+		tmplPath := "static/blocked.html"
+
+		tmpl, err := template.ParseFiles(tmplPath)
+		if err != nil {
+			slog.Error("failed to parse template: ", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Internal server error"))
+			return
+		}
+
+		var reopensAt string
+		if !event.ReopensAt.IsZero() {
+			reopensAt = event.ReopensAt.Add(-time.Duration(event.UTCOffset) * time.Minute).Format("Monday 15:04")
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusForbidden)
+		err = tmpl.Execute(w, struct {
+			Domain     string
+			Category   string
+			PresetName string
+			ReopensAt  string
+		}{
+			Domain:     event.Domain,
+			Category:   event.Category,
+			PresetName: event.PresetName,
+			ReopensAt:  reopensAt,
+		})
+		if err != nil {
+			slog.Error("failed to execute template: ", "error", err)
+			return
+		}
+	}
+}
+
+func handleInterstitialContinue(dnsService blockService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain := r.Host
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			domain = host
+		}
+		// other sites must not confirm on behalf of the user
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		event, ok := dnsService.ConfirmBlock(service.ParseClientAddr(r.RemoteAddr), domain, r.PostFormValue("token"))
+		if !ok {
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		if err := dnsService.AllowSoftBlocked(r.Context(), event); err != nil {
+			slog.Error("failed to allow soft blocked domain", "domain", domain, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		renderInterstitial(w, r, event, "", true)
+	}
+}
+
+// renderInterstitial asks the user to confirm opening the domain. Once
+// confirmed, the page reloads the site after clients dropped the cached
+// interstitial answer. Without a token the page cannot be confirmed.
+func renderInterstitial(w http.ResponseWriter, r *http.Request, event service.BlockEvent, token string, confirmed bool) {
+	tmplPath := "static/interstitial.html"
+
+	tmpl, err := template.ParseFiles(tmplPath)
+	if err != nil {
+		slog.Error("failed to parse template: ", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error"))
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err = tmpl.Execute(w, struct {
+		Domain         string
+		Category       string
+		PresetName     string
+		Token          string
+		Confirmed      bool
+		TargetURL      string
+		RefreshSeconds int
+	}{
+		Domain:         event.Domain,
+		Category:       event.Category,
+		PresetName:     event.PresetName,
+		Token:          token,
+		Confirmed:      confirmed,
+		TargetURL:      scheme + "://" + event.Domain + "/",
+		RefreshSeconds: service.InterstitialTTL + 1,
+	})
+	if err != nil {
+		slog.Error("failed to execute template: ", "error", err)
+		return
+	}
+}
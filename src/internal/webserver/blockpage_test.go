@@ -0,0 +1,317 @@
+package webserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quaintdev/webshield/src/internal/service"
+)
+
+func TestMain(m *testing.M) {
+	// templates are read from static/ at the root of the repository
+	if err := os.Chdir("../../.."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeBlocks serves blocks from a block log and remembers the soft blocks
+// it was asked to lift
+type fakeBlocks struct {
+	*service.BlockLog
+	allowed []service.BlockEvent
+}
+
+func (f *fakeBlocks) LookupBlock(client netip.Addr, domain string) (service.BlockEvent, bool) {
+	return f.Lookup(client, domain)
+}
+
+func (f *fakeBlocks) IssueBlockToken(client netip.Addr, domain string) (string, bool) {
+	return f.IssueToken(client, domain)
+}
+
+func (f *fakeBlocks) ConfirmBlock(client netip.Addr, domain string, token string) (service.BlockEvent, bool) {
+	return f.Confirm(client, domain, token)
+}
+
+func (f *fakeBlocks) AllowSoftBlocked(_ context.Context, event service.BlockEvent) error {
+	f.allowed = append(f.allowed, event)
+	return nil
+}
+
+// newTestCA writes a throwaway CA to a temporary directory and returns the
+// block page configuration using it along with a pool trusting it
+func newTestCA(t *testing.T) (*service.BlockPageConf, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	conf := &service.BlockPageConf{
+		CACertPath: filepath.Join(dir, "ca.pem"),
+		CAKeyPath:  filepath.Join(dir, "ca-key.pem"),
+	}
+	if err := os.WriteFile(conf.CACertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(conf.CAKeyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return conf, pool
+}
+
+func TestBlockPageServer_getCertificate(t *testing.T) {
+	blocks := &fakeBlocks{BlockLog: service.NewBlockLog()}
+	blocks.Record(netip.MustParseAddr("192.0.2.1"), service.BlockEvent{Domain: "blocked.example."})
+	conf, pool := newTestCA(t)
+	s := NewBlockPageServer(blocks, conf)
+	if err := s.loadCA(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{GetCertificate: s.getCertificate}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		serverName string
+		wantErr    bool
+	}{
+		{name: "recently blocked name", serverName: "blocked.example"},
+		{name: "recently blocked name in upper case", serverName: "BLOCKED.example"},
+		{name: "name that was not blocked", serverName: "bank.example", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: tt.serverName},
+			}}
+			resp, err := client.Get(ts.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("TLS handshake for %s error = %v, wantErr %v", tt.serverName, err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := s.getCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("BlockPageServer.getCertificate() minted a certificate without server name")
+	}
+	first, err := s.getCertificate(&tls.ClientHelloInfo{ServerName: "blocked.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, _ := s.getCertificate(&tls.ClientHelloInfo{ServerName: "blocked.example"}); second != first {
+		t.Error("BlockPageServer.getCertificate() minted a new certificate, want the cached one")
+	}
+	if len(s.certs) != 1 {
+		t.Errorf("BlockPageServer cached %d certificates, want only the blocked name", len(s.certs))
+	}
+}
+
+func TestBlockPageServer_storeCertificate(t *testing.T) {
+	certExpiring := func(d time.Duration) *tls.Certificate {
+		return &tls.Certificate{Leaf: &x509.Certificate{NotAfter: time.Now().Add(d)}}
+	}
+	// fill fills the cache, name-0 expiring first
+	fill := func(s *BlockPageServer) {
+		for i := range maxCachedCerts {
+			s.certs["name-"+strconv.Itoa(i)] = certExpiring(48*time.Hour + time.Duration(i)*time.Minute)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		prepare   func(s *BlockPageServer)
+		wantGone  []string
+		wantKept  []string
+		wantCount int
+	}{
+		{
+			name:      "room left",
+			prepare:   func(s *BlockPageServer) { s.certs["name-0"] = certExpiring(48 * time.Hour) },
+			wantKept:  []string{"name-0"},
+			wantCount: 2,
+		},
+		{
+			name:      "full cache drops the certificate expiring first",
+			prepare:   fill,
+			wantGone:  []string{"name-0"},
+			wantKept:  []string{"name-1", "name-" + strconv.Itoa(maxCachedCerts-1)},
+			wantCount: maxCachedCerts,
+		},
+		{
+			name: "full cache drops expiring certificates",
+			prepare: func(s *BlockPageServer) {
+				fill(s)
+				s.certs["name-5"] = certExpiring(time.Minute)
+				s.certs["name-6"] = certExpiring(time.Minute)
+			},
+			wantGone:  []string{"name-5", "name-6"},
+			wantKept:  []string{"name-0"},
+			wantCount: maxCachedCerts - 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewBlockPageServer(&fakeBlocks{BlockLog: service.NewBlockLog()}, &service.BlockPageConf{})
+			tt.prepare(s)
+			s.storeCertificate("new.example", certExpiring(leafCertValidity))
+
+			if _, ok := s.certs["new.example"]; !ok {
+				t.Error("BlockPageServer.storeCertificate() did not cache the new certificate")
+			}
+			if len(s.certs) != tt.wantCount {
+				t.Errorf("BlockPageServer cached %d certificates, want %d", len(s.certs), tt.wantCount)
+			}
+			for _, name := range tt.wantGone {
+				if _, ok := s.certs[name]; ok {
+					t.Errorf("BlockPageServer.storeCertificate() kept %s", name)
+				}
+			}
+			for _, name := range tt.wantKept {
+				if _, ok := s.certs[name]; !ok {
+					t.Errorf("BlockPageServer.storeCertificate() dropped %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleInterstitialContinue(t *testing.T) {
+	client := netip.MustParseAddr("192.0.2.1")
+	tokenPattern := regexp.MustCompile(`name="token" value="([0-9a-f]+)"`)
+	// render shows the interstitial to client and returns the token of its form
+	render := func(t *testing.T, blocks *fakeBlocks) string {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "http://soft.example/", nil)
+		r.RemoteAddr = client.String() + ":41000"
+		w := httptest.NewRecorder()
+		handleBlockPage(blocks)(w, r)
+		match := tokenPattern.FindStringSubmatch(w.Body.String())
+		if match == nil {
+			t.Fatalf("interstitial page has no token: %s", w.Body.String())
+		}
+		return match[1]
+	}
+
+	tests := []struct {
+		name        string
+		remoteAddr  string
+		origin      string
+		token       func(token string) string
+		wantStatus  int
+		wantAllowed bool
+	}{
+		{
+			name:        "valid token",
+			token:       func(token string) string { return token },
+			wantStatus:  http.StatusOK,
+			wantAllowed: true,
+		},
+		{
+			name:        "valid token with same origin",
+			origin:      "http://soft.example",
+			token:       func(token string) string { return token },
+			wantStatus:  http.StatusOK,
+			wantAllowed: true,
+		},
+		{
+			name:       "cross origin",
+			origin:     "http://evil.example",
+			token:      func(token string) string { return token },
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "missing token",
+			token:      func(string) string { return "" },
+			wantStatus: http.StatusSeeOther,
+		},
+		{
+			name:       "wrong token",
+			token:      func(string) string { return strings.Repeat("0", 32) },
+			wantStatus: http.StatusSeeOther,
+		},
+		{
+			name:       "token of another client",
+			remoteAddr: "192.0.2.2:41000",
+			token:      func(token string) string { return token },
+			wantStatus: http.StatusSeeOther,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks := &fakeBlocks{BlockLog: service.NewBlockLog()}
+			blocks.Record(client, service.BlockEvent{Domain: "soft.example.", PresetID: "preset", SoftBlock: true})
+			form := url.Values{"token": {tt.token(render(t, blocks))}}
+
+			r := httptest.NewRequest(http.MethodPost, "http://soft.example/continue", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.RemoteAddr = client.String() + ":41000"
+			if tt.remoteAddr != "" {
+				r.RemoteAddr = tt.remoteAddr
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			handleInterstitialContinue(blocks)(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("handleInterstitialContinue() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusSeeOther && w.Header().Get("Location") != "/" {
+				t.Errorf("handleInterstitialContinue() redirected to %q, want /", w.Header().Get("Location"))
+			}
+			if allowed := len(blocks.allowed) == 1 && blocks.allowed[0].PresetID == "preset"; allowed != tt.wantAllowed {
+				t.Errorf("handleInterstitialContinue() allowed %v, want allowed %v", blocks.allowed, tt.wantAllowed)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package webserver
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -9,8 +10,10 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"net/netip"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/miekg/dns"
 	"github.com/quaintdev/webshield/src/internal/apperrors"
@@ -29,7 +32,7 @@ func handleAddConfiguration(service *service.DataMgmtService) func(w http.Respon
 		var req *dto.AddPresetRequest
 		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
-			slog.Error("Failed to decode configuration: ", err)
+			slog.Error("Failed to decode configuration: ", "error", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -131,6 +134,175 @@ func handleConfigurationState(service *service.DataMgmtService) func(w http.Resp
 	}
 }
 
+func handleGetRewrites(service *service.DataMgmtService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		configId := r.PathValue("configId")
+		rewrites, err := service.GetRewrites(r.Context(), configId)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(rewrites)
+	}
+}
+
+func handleUpdateRewrites(service *service.DataMgmtService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		configId := r.PathValue("configId")
+		slog.Debug("PUT rewrites request received", "configId", configId)
+		var req []dto.Rewrite
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			slog.Error("Failed to decode rewrites: ", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rewrites, err := service.UpdateRewrites(r.Context(), configId, req)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(rewrites)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, apperrors.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, apperrors.ErrInvalidInput):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, apperrors.ErrLastUpstream):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, apperrors.ErrUnauthorized):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		slog.Error("Failed to process request: ", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// requireAdmin lets only requests carrying the admin token through. Without
+// a configured token every request is refused.
+func requireAdmin(token string, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			writeAPIError(w, apperrors.ErrUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func handleGetUpstreams(upstreamService *service.UpstreamMgmtService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(upstreamService.GetUpstreams())
+	}
+}
+
+func handleAddUpstream(upstreamService *service.UpstreamMgmtService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Address string `json:"address"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = upstreamService.AddUpstream(r.Context(), req.Address)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(upstreamService.GetUpstreams())
+	}
+}
+
+func handleRemoveUpstream(upstreamService *service.UpstreamMgmtService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// addresses contain slashes, so they are passed as query parameter
+		address := r.URL.Query().Get("address")
+		err := upstreamService.RemoveUpstream(r.Context(), address)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleDrainUpstream(upstreamService *service.UpstreamMgmtService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Address string `json:"address"`
+			Drained bool   `json:"drained"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = upstreamService.DrainUpstream(r.Context(), req.Address, req.Drained)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(upstreamService.GetUpstreams())
+	}
+}
+
+func handleReorderUpstreams(upstreamService *service.UpstreamMgmtService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var addresses []string
+		err := json.NewDecoder(r.Body).Decode(&addresses)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = upstreamService.ReorderUpstreams(r.Context(), addresses)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(upstreamService.GetUpstreams())
+	}
+}
+
+func handleGetCacheStats(dnsService *service.DNSService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(dnsService.CacheStats())
+	}
+}
+
+func handleGetCacheEntries(dnsService *service.DNSService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(dnsService.CacheEntries(name))
+	}
+}
+
+// handleFlushCache flushes one name with ?name=, a domain and its subdomains
+// with ?suffix=, or the whole cache without parameters
+func handleFlushCache(dnsService *service.DNSService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var flushed int
+		if suffix := r.URL.Query().Get("suffix"); suffix != "" {
+			flushed = dnsService.FlushCache(suffix, true)
+		} else {
+			flushed = dnsService.FlushCache(r.URL.Query().Get("name"), false)
+		}
+		json.NewEncoder(w).Encode(struct {
+			Flushed int `json:"flushed"`
+		}{flushed})
+	}
+}
+
 func handleGuide(w http.ResponseWriter, r *http.Request) {
 
 	configId := r.URL.Query().Get("configId")
@@ -163,7 +335,7 @@ func handleGuide(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleDoHQuery(service *service.DNSService) func(w http.ResponseWriter, r *http.Request) {
+func handleDoHQuery(dnsService *service.DNSService, trustedProxies []netip.Prefix) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Only accept GET and POST methods
 		if r.Method != http.MethodGet && r.Method != http.MethodPost {
@@ -211,7 +383,8 @@ func handleDoHQuery(service *service.DNSService) func(w http.ResponseWriter, r *
 			return
 		}
 
-		response, err := service.ProcessQuery(r.Context(), msg, configId)
+		ctx := service.WithClientAddr(r.Context(), clientAddr(r, trustedProxies))
+		response, err := dnsService.ProcessQuery(ctx, msg, configId)
 		if err != nil {
 			return
 		}
@@ -230,6 +403,31 @@ func handleDoHQuery(service *service.DNSService) func(w http.ResponseWriter, r *
 	}
 }
 
+// clientAddr returns the address of the client. X-Forwarded-For is only
+// honoured when sent by trusted proxies, walking back from the peer to the
+// first address a trusted proxy did not add.
+func clientAddr(r *http.Request, trustedProxies []netip.Prefix) netip.Addr {
+	addr := service.ParseClientAddr(r.RemoteAddr)
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0 && isTrustedProxy(addr, trustedProxies); i-- {
+		hop := service.ParseClientAddr(strings.TrimSpace(hops[i]))
+		if !hop.IsValid() {
+			break
+		}
+		addr = hop
+	}
+	return addr
+}
+
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 // getCacheHeader determines the Cache-Control header based on DNS response
 func getCacheHeader(msg *dns.Msg) string {
 	// Find the lowest TTL in the response
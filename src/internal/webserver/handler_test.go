@@ -0,0 +1,115 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	trustedProxies := []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.1/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}
+
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		forwardedFor   string
+		trustedProxies []netip.Prefix
+		want           string
+	}{
+		{name: "direct client", remoteAddr: "198.51.100.7:41000", want: "198.51.100.7"},
+		{name: "untrusted peer setting the header", remoteAddr: "198.51.100.7:41000", forwardedFor: "192.0.2.1", trustedProxies: trustedProxies, want: "198.51.100.7"},
+		{name: "no trusted proxies configured", remoteAddr: "127.0.0.1:41000", forwardedFor: "192.0.2.1", want: "127.0.0.1"},
+		{name: "trusted proxy", remoteAddr: "127.0.0.1:41000", forwardedFor: "192.0.2.1", trustedProxies: trustedProxies, want: "192.0.2.1"},
+		{name: "trusted proxy without header", remoteAddr: "127.0.0.1:41000", trustedProxies: trustedProxies, want: "127.0.0.1"},
+		{name: "chain of trusted proxies", remoteAddr: "127.0.0.1:41000", forwardedFor: "192.0.2.1, 10.1.2.3", trustedProxies: trustedProxies, want: "192.0.2.1"},
+		{name: "spoofed entry before the client", remoteAddr: "127.0.0.1:41000", forwardedFor: "203.0.113.9, 192.0.2.1", trustedProxies: trustedProxies, want: "192.0.2.1"},
+		{name: "malformed entry", remoteAddr: "127.0.0.1:41000", forwardedFor: "not-an-ip", trustedProxies: trustedProxies, want: "127.0.0.1"},
+		{name: "ipv6 client", remoteAddr: "127.0.0.1:41000", forwardedFor: "2001:db8::1", trustedProxies: trustedProxies, want: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/doh/preset", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if got := clientAddr(r, tt.trustedProxies); got != netip.MustParseAddr(tt.want) {
+				t.Errorf("clientAddr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	const token = "s3cret-admin-token"
+
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "correct token", token: token, authorization: "Bearer " + token, wantStatus: http.StatusOK},
+		{name: "missing token", token: token, wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", token: token, authorization: "Bearer wrong", wantStatus: http.StatusUnauthorized},
+		{name: "token prefix", token: token, authorization: "Bearer s3cret", wantStatus: http.StatusUnauthorized},
+		{name: "basic scheme", token: token, authorization: "Basic " + token, wantStatus: http.StatusUnauthorized},
+		{name: "token without scheme", token: token, authorization: token, wantStatus: http.StatusUnauthorized},
+		{name: "no token configured", authorization: "Bearer ", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			handler := requireAdmin(tt.token, func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			r := httptest.NewRequest(http.MethodDelete, "/api/cache", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("requireAdmin() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if called != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("requireAdmin() called the admin handler = %v, want %v", called, !called)
+			}
+		})
+	}
+}
+
+func TestWebServer_adminRoutes(t *testing.T) {
+	const token = "s3cret-admin-token"
+	// the services are never reached without the token
+	mux := NewWebServer(nil, nil, nil, token, nil).routes()
+
+	routes := []struct{ method, path string }{
+		{http.MethodGet, "/api/upstreams"},
+		{http.MethodPost, "/api/upstreams"},
+		{http.MethodDelete, "/api/upstreams"},
+		{http.MethodPost, "/api/upstreams/drain"},
+		{http.MethodPut, "/api/upstreams/order"},
+		{http.MethodGet, "/api/cache"},
+		{http.MethodGet, "/api/cache/entries"},
+		{http.MethodDelete, "/api/cache"},
+	}
+	for _, route := range routes {
+		for _, authorization := range []string{"", "Bearer wrong", "Basic " + token} {
+			r := httptest.NewRequest(route.method, route.path, nil)
+			if authorization != "" {
+				r.Header.Set("Authorization", authorization)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s with authorization %q status = %d, want %d", route.method, route.path, authorization, w.Code, http.StatusUnauthorized)
+			}
+		}
+	}
+}
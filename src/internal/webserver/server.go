@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/netip"
 	"os"
 	"sync"
 
@@ -12,15 +13,22 @@ import (
 )
 
 type WebServer struct {
-	dtMgmtService *service.DataMgmtService
-	server        *http.Server
-	dnsService    *service.DNSService
+	dtMgmtService       *service.DataMgmtService
+	server              *http.Server
+	dnsService          *service.DNSService
+	upstreamMgmtService *service.UpstreamMgmtService
+	adminToken          string
+	trustedProxies      []netip.Prefix
 }
 
-func NewWebServer(dtMgmtService *service.DataMgmtService, dnsService *service.DNSService) *WebServer {
+func NewWebServer(dtMgmtService *service.DataMgmtService, dnsService *service.DNSService,
+	upstreamMgmtService *service.UpstreamMgmtService, adminToken string, trustedProxies []netip.Prefix) *WebServer {
 	return &WebServer{
-		dtMgmtService: dtMgmtService,
-		dnsService:    dnsService,
+		dtMgmtService:       dtMgmtService,
+		dnsService:          dnsService,
+		upstreamMgmtService: upstreamMgmtService,
+		adminToken:          adminToken,
+		trustedProxies:      trustedProxies,
 	}
 }
 
@@ -35,6 +43,22 @@ func (s *WebServer) Shutdown(ctx context.Context) {
 func (s *WebServer) Start(wg *sync.WaitGroup) {
 	defer wg.Done()
 
+	port := os.Getenv("PORT")
+	s.server = &http.Server{
+		Addr:    ":" + port,
+		Handler: s.routes(),
+	}
+
+	slog.Info("WebServer started", "port", port)
+	err := s.server.ListenAndServe()
+	if err != nil {
+		fmt.Println("error starting server", err)
+		return
+	}
+}
+
+// routes registers the panel, the API and the DoH endpoint
+func (s *WebServer) routes() *http.ServeMux {
 	mux := http.NewServeMux()
 
 	fs := http.FileServer(http.Dir("static"))
@@ -52,19 +76,20 @@ func (s *WebServer) Start(wg *sync.WaitGroup) {
 	mux.HandleFunc("DELETE /api/configurations/{configId}", handleDeleteConfiguration(s.dtMgmtService))
 	mux.HandleFunc("POST /api/configurations/{configId}/state", handleConfigurationState(s.dtMgmtService))
 	mux.HandleFunc("GET /api/configurations", handleGetConfigurations(s.dtMgmtService))
+	mux.HandleFunc("GET /api/configurations/{configId}/rewrites", handleGetRewrites(s.dtMgmtService))
+	mux.HandleFunc("PUT /api/configurations/{configId}/rewrites", handleUpdateRewrites(s.dtMgmtService))
+	// upstreams and the cache are shared by every user, only the admin sees
+	// and changes them
+	mux.HandleFunc("GET /api/upstreams", requireAdmin(s.adminToken, handleGetUpstreams(s.upstreamMgmtService)))
+	mux.HandleFunc("POST /api/upstreams", requireAdmin(s.adminToken, handleAddUpstream(s.upstreamMgmtService)))
+	mux.HandleFunc("DELETE /api/upstreams", requireAdmin(s.adminToken, handleRemoveUpstream(s.upstreamMgmtService)))
+	mux.HandleFunc("POST /api/upstreams/drain", requireAdmin(s.adminToken, handleDrainUpstream(s.upstreamMgmtService)))
+	mux.HandleFunc("PUT /api/upstreams/order", requireAdmin(s.adminToken, handleReorderUpstreams(s.upstreamMgmtService)))
+	mux.HandleFunc("GET /api/cache", requireAdmin(s.adminToken, handleGetCacheStats(s.dnsService)))
+	mux.HandleFunc("GET /api/cache/entries", requireAdmin(s.adminToken, handleGetCacheEntries(s.dnsService)))
+	mux.HandleFunc("DELETE /api/cache", requireAdmin(s.adminToken, handleFlushCache(s.dnsService)))
 
 	//DoH Server
-	mux.HandleFunc("/doh/{configId}", handleDoHQuery(s.dnsService))
-	port := os.Getenv("PORT")
-	s.server = &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
-	}
-
-	slog.Info("WebServer started", "port", port)
-	err := s.server.ListenAndServe()
-	if err != nil {
-		fmt.Println("error starting server", err)
-		return
-	}
+	mux.HandleFunc("/doh/{configId}", handleDoHQuery(s.dnsService, s.trustedProxies))
+	return mux
 }
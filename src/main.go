@@ -72,12 +72,34 @@ func main() {
 	defer dataStore.Close()
 
 	settingsRepo := repository.SettingsRepository(dataStore)
+	rewriteRepo := repository.RewriteRepository(dataStore)
+	upstreamRepo := repository.UpstreamRepository(dataStore)
+	cacheRepo := repository.CacheRepository(dataStore)
 
 	//init services
 	serverSelector := service.NewDNSServerSelector(configService.GetDNSServers())
+	if err := serverSelector.UseStrategy(configService.GetUpstreamConf()); err != nil {
+		slog.Error("invalid upstream configuration", "error", err)
+		return
+	}
+	rewriteStore := service.NewRewriteStore(rewriteRepo)
 	filteringService := service.NewFilteringService(settingsRepo, domainDataRepo)
-	dnsService := service.NewDNSService(serverSelector, filteringService, configService)
-	userService := service.NewDataMgmtService(settingsRepo, configService)
+	dnsService := service.NewDNSService(serverSelector, filteringService, rewriteStore, configService)
+	defer dnsService.Close()
+	dnsService.StartHealthChecks(ctx)
+	persistCache := configService.GetCacheConf().Persist
+	if persistCache {
+		if err := dnsService.LoadCache(ctx, cacheRepo); err != nil {
+			slog.Error("error while restoring cache", "error", err)
+		}
+		dnsService.StartCacheSnapshots(ctx, cacheRepo)
+	}
+	userService := service.NewDataMgmtService(settingsRepo, rewriteStore, configService)
+	upstreamService := service.NewUpstreamMgmtService(dnsService, upstreamRepo)
+	if err := upstreamService.LoadUpstreams(ctx); err != nil {
+		slog.Error("error while loading upstream servers", "error", err)
+		return
+	}
 
 	// Set up signal handling for graceful shutdown
 	signalCh := make(chan os.Signal, 1)
@@ -85,10 +107,22 @@ func main() {
 
 	var wg sync.WaitGroup
 
-	server := webserver.NewWebServer(userService, dnsService)
+	trustedProxies, err := service.ParseTrustedProxies(configService.GetTrustedProxies())
+	if err != nil {
+		slog.Error("invalid trusted proxies", "error", err)
+		return
+	}
+	server := webserver.NewWebServer(userService, dnsService, upstreamService, configService.GetAdminToken(), trustedProxies)
 	wg.Add(1)
 	go server.Start(&wg)
 
+	var blockPageServer *webserver.BlockPageServer
+	if blockPageConf := configService.GetBlockPageConf(); blockPageConf.HTTPAddr != "" || blockPageConf.HTTPSAddr != "" {
+		blockPageServer = webserver.NewBlockPageServer(dnsService, blockPageConf)
+		wg.Add(1)
+		go blockPageServer.Start(&wg)
+	}
+
 	if os.Getenv("DOT_SERVER_DISABLED") != "true" {
 		dotServer := dot.NewDotServer(dnsService)
 		wg.Add(1)
@@ -102,7 +136,16 @@ func main() {
 		slog.Info("Received signal, shutting down DNS server", "signal", sig)
 		cancel()
 		server.Shutdown(ctx)
+		if blockPageServer != nil {
+			blockPageServer.Shutdown(ctx)
+		}
 	}
 
 	wg.Wait()
+
+	if persistCache {
+		if err := dnsService.SaveCache(context.Background(), cacheRepo); err != nil {
+			slog.Error("error while saving cache", "error", err)
+		}
+	}
 }